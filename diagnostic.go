@@ -0,0 +1,227 @@
+package flexml
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// DiagnosticKind represents the kind of problem described by a Diagnostic
+type DiagnosticKind int
+
+const (
+	// UnclosedElement means an element was closed without an end tag
+	UnclosedElement DiagnosticKind = iota
+	// StrayEndTag means an end tag did not match the innermost open element
+	// and was ignored
+	StrayEndTag
+	// BadAttribute means an attribute was malformed, had no value, had an
+	// unquoted value or was repeated
+	BadAttribute
+	// UnterminatedComment means a comment ran into the end of the input
+	UnterminatedComment
+	// UnterminatedProcessingInstruction means a processing instruction ran
+	// into the end of the input
+	UnterminatedProcessingInstruction
+	// InvalidMarkup means an end tag contained unexpected characters (strict
+	// mode only)
+	InvalidMarkup
+	// InvalidName means a tag or attribute name was missing or started with
+	// a character that cannot start a name
+	InvalidName
+	// UnexpectedEOF means the input ended in the middle of a token
+	UnexpectedEOF
+	// InvalidReference means an '&' did not start a character or entity
+	// reference (strict mode only)
+	InvalidReference
+	// ContentOutsideRoot means text or a second element appeared outside
+	// the root element (strict mode only)
+	ContentOutsideRoot
+	// MissingRoot means the input has no root element (strict mode only)
+	MissingRoot
+	// StrayLessThan means a '<' that does not start markup was kept as text
+	StrayLessThan
+)
+
+// snippetRadius is the number of bytes of input on each side of a problem
+// included in a ParseError
+const snippetRadius = 20
+
+// Diagnostic describes a problem in the input that the parser recovered from
+type Diagnostic struct {
+	Kind    DiagnosticKind
+	Message string
+	Offset  int // Input offset of the problem
+	Line    int // Line of the problem, starting at 1
+	Column  int // Column of the problem, starting at 1
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s at line %d, column %d", d.Message, d.Line, d.Column)
+}
+
+// ParseError describes a problem in the input that stopped parsing
+type ParseError struct {
+	Kind    DiagnosticKind
+	Message string
+	Offset  int    // Input offset of the problem
+	Line    int    // Line of the problem, starting at 1
+	Column  int    // Column of the problem, starting at 1
+	Snippet string // Input surrounding the problem, as far as it is still buffered
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at line %d, column %d", e.Message, e.Line, e.Column)
+}
+
+// errorf returns a ParseError for a problem at the current position
+func (p *parser) errorf(kind DiagnosticKind, format string, args ...any) *ParseError {
+	return &ParseError{
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+		Offset:  p.base + p.pos,
+		Line:    p.line,
+		Column:  p.col,
+		Snippet: p.snippet(p.pos),
+	}
+}
+
+// strictErr returns the first problem as a ParseError in strict mode
+func (p *parser) strictErr() error {
+	if !p.opts.strict || len(p.diagnostics) == 0 {
+		return nil
+	}
+
+	d := p.diagnostics[0]
+	return &ParseError{
+		Kind:    d.Kind,
+		Message: d.Message,
+		Offset:  d.Offset,
+		Line:    d.Line,
+		Column:  d.Column,
+		Snippet: p.snippet(d.Offset - p.base),
+	}
+}
+
+// checkText records '&' characters in text that do not start a character or
+// entity reference, in strict mode. The text starts at the given position.
+// The content of raw text elements is not checked.
+func (p *parser) checkText(text string, offset, line, col int) {
+	if p.raw == "" {
+		p.checkChars(text, false, offset, line, col)
+	}
+}
+
+// checkAttributeValue is like checkText, but also records '<' characters,
+// which cannot appear in attribute values
+func (p *parser) checkAttributeValue(value string, offset, line, col int) {
+	p.checkChars(value, true, offset, line, col)
+}
+
+// checkChars records the first '&' in text that does not start a reference,
+// and the first '<' if lessThan is set, in strict mode
+func (p *parser) checkChars(text string, lessThan bool, offset, line, col int) {
+	if !p.opts.strict {
+		return
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] == '&' && !isReference(text[i:]) {
+			p.diagnoseAt(InvalidReference, offset+i, line, col, "'&' does not start a reference")
+			return
+		}
+
+		if text[i] == '<' && lessThan {
+			p.diagnoseAt(StrayLessThan, offset+i, line, col, "'<' is not allowed in an attribute value")
+			return
+		}
+
+		if text[i] == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+}
+
+// isReference reports whether s starts with a reference such as &amp;,
+// &#60; or &#x3c;
+func isReference(s string) bool {
+	end := strings.IndexByte(s, ';')
+	if end < 2 {
+		return false
+	}
+
+	ref := s[1:end]
+	if digits, ok := strings.CutPrefix(ref, "#x"); ok {
+		return digits != "" && strings.Trim(digits, "0123456789abcdefABCDEF") == ""
+	}
+	if digits, ok := strings.CutPrefix(ref, "#"); ok {
+		return digits != "" && strings.Trim(digits, "0123456789") == ""
+	}
+
+	for i := 0; i < len(ref); i++ {
+		if !isNameChar(ref[i]) || (i == 0 && !isNameStartChar(ref[i])) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// snippet returns the buffered input around pos, cut at character boundaries
+func (p *parser) snippet(pos int) string {
+	pos = min(max(pos, 0), len(p.input))
+	start := max(pos-snippetRadius, 0)
+	for start < pos && !utf8.RuneStart(p.input[start]) {
+		start++
+	}
+
+	end := min(pos+snippetRadius, len(p.input))
+	for end > pos && end < len(p.input) && !utf8.RuneStart(p.input[end]) {
+		end--
+	}
+
+	return string(p.input[start:end])
+}
+
+// diagnose records a problem at the current position
+func (p *parser) diagnose(kind DiagnosticKind, format string, args ...any) {
+	p.diagnoseAt(kind, p.base+p.pos, p.line, p.col, format, args...)
+}
+
+// diagnoseAt records a problem at the given position. Beyond the diagnostic
+// limit, problems are only counted.
+func (p *parser) diagnoseAt(kind DiagnosticKind, offset, line, col int, format string, args ...any) {
+	if limit := p.opts.diagnosticLimit; limit > 0 && len(p.diagnostics) >= limit {
+		p.dropped++
+		return
+	}
+
+	p.diagnostics = append(p.diagnostics, Diagnostic{
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+		Offset:  offset,
+		Line:    line,
+		Column:  col,
+	})
+}
+
+// recorded returns the number of problems recorded so far, including the
+// ones beyond the diagnostic limit. It serves as a mark for
+// rewindDiagnostics.
+func (p *parser) recorded() int {
+	return len(p.diagnostics) + p.dropped
+}
+
+// rewindDiagnostics forgets the problems recorded after the first n, when a
+// token is read again
+func (p *parser) rewindDiagnostics(n int) {
+	if n < len(p.diagnostics) {
+		p.diagnostics = p.diagnostics[:n]
+		p.dropped = 0
+	} else {
+		p.dropped = n - len(p.diagnostics)
+	}
+}
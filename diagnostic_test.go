@@ -0,0 +1,342 @@
+package flexml
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestDiagnostics(t *testing.T) {
+	input := "<doc x=1 y x=\"2\">\n<b>text</c></b></e><d>"
+
+	expected := []Diagnostic{
+		{Kind: BadAttribute, Message: "attribute 'x' has an unquoted value", Offset: 5, Line: 1, Column: 6},
+		{Kind: BadAttribute, Message: "attribute 'y' has no value", Offset: 9, Line: 1, Column: 10},
+		{Kind: BadAttribute, Message: "duplicate attribute 'x'", Offset: 11, Line: 1, Column: 12},
+		{Kind: StrayEndTag, Message: "end tag 'c' does not match the open element 'b'", Offset: 25, Line: 2, Column: 8},
+		{Kind: StrayEndTag, Message: "end tag 'e' does not match the open element 'doc'", Offset: 33, Line: 2, Column: 16},
+		{Kind: UnclosedElement, Message: "element 'd' is not closed", Offset: 40, Line: 2, Column: 23},
+		{Kind: UnclosedElement, Message: "element 'doc' is not closed", Offset: 40, Line: 2, Column: 23},
+	}
+
+	doc, err := Parse(input)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	if !reflect.DeepEqual(doc.Diagnostics, expected) {
+		t.Errorf("Expected Parse diagnostics:\n%v\nGot:\n%v", expected, doc.Diagnostics)
+	}
+
+	// Feeding the input byte by byte must not repeat or lose diagnostics
+	stream := NewStream()
+	for i := range len(input) {
+		stream.AddData([]byte{input[i]})
+		for stream.Next() {
+		}
+	}
+	stream.EOF()
+	for stream.Next() {
+	}
+
+	if !reflect.DeepEqual(stream.Diagnostics(), expected) {
+		t.Errorf("Expected Stream diagnostics:\n%v\nGot:\n%v", expected, stream.Diagnostics())
+	}
+
+	streamDoc, _ := ParseReader(strings.NewReader(input))
+	if !reflect.DeepEqual(streamDoc.Diagnostics, expected) {
+		t.Errorf("Expected StreamDocument diagnostics:\n%v\nGot:\n%v", expected, streamDoc.Diagnostics)
+	}
+
+	builder := NewTreeBuilder()
+	builder.AddData([]byte(input))
+	builder.EOF()
+
+	if !reflect.DeepEqual(builder.Document().Diagnostics, expected) {
+		t.Errorf("Expected TreeBuilder diagnostics:\n%v\nGot:\n%v", expected, builder.Document().Diagnostics)
+	}
+}
+
+func TestDiagnosticsUnterminated(t *testing.T) {
+	stream := NewStream()
+	stream.AddData([]byte("<a><!-- open"))
+	stream.EOF()
+	for stream.Next() {
+	}
+
+	diagnostics := stream.Diagnostics()
+	if len(diagnostics) != 2 || diagnostics[0].Kind != UnterminatedComment || diagnostics[1].Kind != UnclosedElement {
+		t.Fatalf("Expected an unterminated comment and an unclosed element, got %v", diagnostics)
+	}
+
+	if diagnostics[0].String() != "comment is not terminated at line 1, column 4" {
+		t.Errorf("Unexpected diagnostic string: %s", diagnostics[0].String())
+	}
+
+	// Parse records the problem once, like the stream
+	for _, input := range []string{"<a>x <!-- open", "<doc><d>x <?pi open", "<!-- open"} {
+		doc, err := Parse(input)
+		if err != nil {
+			t.Fatalf("Expected Parse to recover, got %v", err)
+		}
+
+		streamDoc, _ := ParseReader(strings.NewReader(input))
+		if !reflect.DeepEqual(doc.Diagnostics, streamDoc.Diagnostics) {
+			t.Errorf("Expected the diagnostics of the stream:\n%v\nGot:\n%v", streamDoc.Diagnostics, doc.Diagnostics)
+		}
+	}
+
+	doc, _ := Parse("<a>x <!-- open")
+	if a, _ := doc.FindOne("a"); len(a.Children) != 2 || a.Children[1].Type != CommentNode || a.Children[1].Value != " open" {
+		t.Errorf("Expected the unterminated comment to be kept, got %s", doc.String())
+	}
+}
+
+func TestParseError(t *testing.T) {
+	_, err := Parse("<a>x</a><!-- open", WithStrict())
+
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Kind != UnterminatedComment || perr.Offset != 8 {
+		t.Fatalf("Expected a *ParseError for the unterminated comment, got %T: %v", err, err)
+	}
+
+	input := "<a>x\n<b>y</b>< 5</a>"
+
+	_, err = Parse(input, WithStrict())
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected a *ParseError, got %T: %v", err, err)
+	}
+
+	expected := &ParseError{
+		Kind:    StrayLessThan,
+		Message: "'<' does not start markup",
+		Offset:  13,
+		Line:    2,
+		Column:  9,
+		Snippet: "<a>x\n<b>y</b>< 5</a>",
+	}
+
+	if !reflect.DeepEqual(perr, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, perr)
+	}
+
+	if err.Error() != "'<' does not start markup at line 2, column 9" {
+		t.Errorf("Unexpected error message: %s", err.Error())
+	}
+
+	// The stream reports the same error, even after compacting its buffer
+	stream := NewStream(WithStrict())
+	for i := range len(input) {
+		stream.AddData([]byte{input[i]})
+		for stream.Next() {
+		}
+	}
+	stream.EOF()
+	for stream.Next() {
+	}
+
+	if !errors.As(stream.Err(), &perr) {
+		t.Fatalf("Expected the stream to report a *ParseError, got %v", stream.Err())
+	}
+
+	// Only the input that is still buffered appears in the snippet
+	if !strings.HasPrefix(perr.Snippet, "< 5") {
+		t.Errorf("Expected the snippet to start at the buffered token, got %q", perr.Snippet)
+	}
+
+	perr.Snippet = expected.Snippet
+	if !reflect.DeepEqual(perr, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, perr)
+	}
+
+	reader := NewElementStreamReader(strings.NewReader(input), WithStrict())
+	for {
+		_, err = reader.ReadNode()
+		if err != nil {
+			break
+		}
+	}
+
+	if !errors.As(err, &perr) || perr.Offset != 13 {
+		t.Errorf("Expected ReadNode to return the ParseError, got %v", err)
+	}
+}
+
+func TestParseErrorSnippet(t *testing.T) {
+	input := "<a>" + strings.Repeat("é", 30) + "< 5" + strings.Repeat("x", 30) + "</a>"
+
+	_, err := Parse(input, WithStrict())
+
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected a *ParseError, got %v", err)
+	}
+
+	if !strings.HasSuffix(strings.Split(perr.Snippet, "<")[0], "é") || !strings.Contains(perr.Snippet, "< 5x") {
+		t.Errorf("Expected the snippet to surround the error, got %q", perr.Snippet)
+	}
+
+	if len(perr.Snippet) > 2*snippetRadius || !utf8.ValidString(perr.Snippet) {
+		t.Errorf("Expected a short valid snippet, got %q", perr.Snippet)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	valid := "<?xml version=\"1.0\"?>\n<doc a=\"1\" b='x &amp; y'>text &#60; &#x3C; <b/><!-- c --></doc>\n"
+
+	doc, err := Parse(valid, WithStrict())
+	if err != nil {
+		t.Fatalf("Expected valid XML to pass, got %v", err)
+	}
+
+	if b, found := doc.FindOne("b"); !found || b.Parent.Name != "doc" {
+		t.Errorf("Expected the usual tree in strict mode, got %s", doc.String())
+	}
+
+	stream := NewStream(WithStrict())
+	stream.AddData([]byte(valid))
+	stream.EOF()
+	for stream.Next() {
+	}
+
+	if stream.Err() != nil {
+		t.Fatalf("Expected valid XML to pass the stream, got %v", stream.Err())
+	}
+
+	// Names may contain non-ASCII characters, also when a character is
+	// split between chunks
+	for _, input := range []string{"<名前 属性=\"値\">x</名前>", "<a><é/><b.é-1/></a>"} {
+		if _, err := Parse(input, WithStrict()); err != nil {
+			t.Errorf("Expected %s to pass, got %v", input, err)
+		}
+
+		stream := NewStream(WithStrict())
+		for i := range len(input) {
+			stream.AddData([]byte{input[i]})
+			for stream.Next() {
+			}
+		}
+		stream.EOF()
+		for stream.Next() {
+		}
+
+		if stream.Err() != nil {
+			t.Errorf("Expected %s to pass the stream, got %v", input, stream.Err())
+		}
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		kind   DiagnosticKind
+		offset int
+	}{
+		{"Mismatched end tag", "<a><b></a></b>", StrayEndTag, 6},
+		{"Missing end tag", "<a><b></b>", UnclosedElement, 10},
+		{"Unquoted attribute", "<a x=1></a>", BadAttribute, 3},
+		{"Attribute without value", "<a x></a>", BadAttribute, 3},
+		{"Duplicate attribute", `<a x="1" x="2"></a>`, BadAttribute, 9},
+		{"Attributes without whitespace", `<a x="1"y="2"></a>`, BadAttribute, 8},
+		{"Unterminated attribute value", `<a x="1></a>`, BadAttribute, 3},
+		{"Stray less-than", "<a>1 < 2</a>", StrayLessThan, 5},
+		{"Stray ampersand", "<a>fish & chips</a>", InvalidReference, 8},
+		{"Stray ampersand in attribute", `<a x="&x"></a>`, InvalidReference, 6},
+		{"Less-than in attribute", `<a b="<"/>`, StrayLessThan, 6},
+		{"Less-than in single-quoted attribute", `<a b='1 < 2'></a>`, StrayLessThan, 8},
+		{"Element after root", "<a/><b/>", ContentOutsideRoot, 4},
+		{"Text after root", "<a/>text", ContentOutsideRoot, 4},
+		{"Whitespace before name", "<a></ a>", StrayLessThan, 3},
+		{"Junk in end tag", "<a></a junk>", InvalidMarkup, 7},
+		{"Unterminated comment", "<a/><!-- x", UnterminatedComment, 4},
+		{"Less-than at end", "<a/><", StrayLessThan, 4},
+		{"Empty document", "", MissingRoot, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(test.input, WithStrict())
+
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("Expected Parse to return a *ParseError, got %v", err)
+			}
+
+			if perr.Kind != test.kind || perr.Offset != test.offset {
+				t.Errorf("Expected Parse error kind %d at %d, got %d at %d: %v", test.kind, test.offset, perr.Kind, perr.Offset, perr)
+			}
+
+			// The lenient parser accepts the same input
+			if _, err := Parse(test.input); err != nil {
+				t.Errorf("Expected the lenient parser to accept the input, got %v", err)
+			}
+
+			stream := NewStream(WithStrict())
+			for i := range len(test.input) {
+				stream.AddData([]byte{test.input[i]})
+				for stream.Next() {
+				}
+			}
+			stream.EOF()
+			for stream.Next() {
+			}
+
+			if !errors.As(stream.Err(), &perr) {
+				t.Fatalf("Expected the stream to fail with a *ParseError, got %v", stream.Err())
+			}
+
+			if perr.Kind != test.kind || perr.Offset != test.offset {
+				t.Errorf("Expected stream error kind %d at %d, got %d at %d: %v", test.kind, test.offset, perr.Kind, perr.Offset, perr)
+			}
+		})
+	}
+}
+
+func TestDiagnosticLimit(t *testing.T) {
+	input := "<a x=1>" + strings.Repeat("x < 5, ", 100) + "</b></a>"
+
+	all, _ := Parse(input)
+	if len(all.Diagnostics) != 102 {
+		t.Fatalf("Expected 102 diagnostics without a limit, got %d", len(all.Diagnostics))
+	}
+
+	doc, _ := Parse(input, WithDiagnosticLimit(10))
+	if !reflect.DeepEqual(doc.Diagnostics, all.Diagnostics[:10]) {
+		t.Errorf("Expected Parse to keep the first 10 diagnostics, got %v", doc.Diagnostics)
+	}
+
+	// The stream keeps and counts the same diagnostics, however the input
+	// is split
+	for _, opts := range [][]Option{{WithDiagnosticLimit(10)}, {WithDiagnosticLimit(10), WithTextDeltas()}} {
+		for _, chunk := range []int{1, 3, len(input)} {
+			stream := NewStream(opts...)
+			for i := 0; i < len(input); i += chunk {
+				stream.AddData([]byte(input[i:min(i+chunk, len(input))]))
+				for stream.Next() {
+				}
+			}
+			stream.EOF()
+			for stream.Next() {
+			}
+
+			if !reflect.DeepEqual(stream.Diagnostics(), all.Diagnostics[:10]) {
+				t.Errorf("Expected the stream to keep the first 10 diagnostics with %d-byte chunks, got %v", chunk, stream.Diagnostics())
+			}
+
+			if stream.DiagnosticCount() != 102 {
+				t.Errorf("Expected the stream to count 102 diagnostics with %d-byte chunks, got %d", chunk, stream.DiagnosticCount())
+			}
+		}
+	}
+
+	builder := NewTreeBuilder(WithDiagnosticLimit(10))
+	for i := range len(input) {
+		builder.AddData([]byte{input[i]})
+	}
+	builder.EOF()
+
+	if !reflect.DeepEqual(builder.Document().Diagnostics, all.Diagnostics[:10]) {
+		t.Errorf("Expected TreeBuilder to keep the first 10 diagnostics, got %v", builder.Document().Diagnostics)
+	}
+}
@@ -0,0 +1,143 @@
+package flexml
+
+import (
+	"errors"
+	"io"
+)
+
+// SkipElement can be returned by a Handler to skip part of the input. When
+// returned from StartElement, the content of that element is skipped. When
+// returned from any other method, the remaining content of the enclosing
+// element, or of the whole input at the top level, is skipped. The
+// EndElement of the skipped element is still delivered, so starts and ends
+// stay balanced.
+var SkipElement = errors.New("skip this element")
+
+// SkipAll can be returned by a Handler to stop parsing. Walk then returns nil.
+var SkipAll = errors.New("skip everything")
+
+// Handler receives the events of a stream, see Walk
+type Handler interface {
+	StartElement(event *Event) error
+	EndElement(event *Event) error
+	Text(event *Event) error
+	Comment(event *Event) error
+	ProcessingInstruction(event *Event) error
+}
+
+// BaseHandler implements Handler by ignoring all events. Embed it to only
+// implement the methods you need.
+type BaseHandler struct{}
+
+// StartElement does nothing
+func (BaseHandler) StartElement(event *Event) error { return nil }
+
+// EndElement does nothing
+func (BaseHandler) EndElement(event *Event) error { return nil }
+
+// Text does nothing
+func (BaseHandler) Text(event *Event) error { return nil }
+
+// Comment does nothing
+func (BaseHandler) Comment(event *Event) error { return nil }
+
+// ProcessingInstruction does nothing
+func (BaseHandler) ProcessingInstruction(event *Event) error { return nil }
+
+// Walk parses the XML read from r and calls the handler for each event. It
+// returns the first error returned by the handler other than SkipElement and
+// SkipAll, or the error that stopped the stream. TextDelta events are not
+// delivered; handlers receive the consolidated Text event instead.
+func Walk(r io.Reader, h Handler, opts ...Option) error {
+	stream, err := ParseStream(r, opts...)
+	if err != nil {
+		return err
+	}
+
+	return WalkStream(stream, h)
+}
+
+// WalkStream calls the handler for each event of the stream, like Walk,
+// until the stream has no more events. For a stream that is fed with
+// AddData or Write and walked after each piece, use a Walker, which keeps
+// track of skipped elements between calls.
+func WalkStream(stream *Stream, h Handler) error {
+	return NewWalker(stream, h).Walk()
+}
+
+// Walker calls a handler for the events of a stream, like Walk, across any
+// number of calls. It is meant for a stream that is fed with AddData or
+// Write: call Walk after each piece to deliver the events available so far.
+type Walker struct {
+	stream    *Stream
+	handler   Handler
+	skipping  bool
+	skipDepth int // Depth of the element whose content is skipped
+	skipName  string
+	stopped   bool // Whether the handler returned SkipAll
+}
+
+// NewWalker creates a walker that calls h for the events of stream
+func NewWalker(stream *Stream, h Handler) *Walker {
+	return &Walker{
+		stream:  stream,
+		handler: h,
+	}
+}
+
+// Walk calls the handler for each event available so far. Elements skipped
+// with SkipElement stay skipped in later calls, and after SkipAll no more
+// events are delivered. It returns the same errors as Walk.
+func (w *Walker) Walk() error {
+	for !w.stopped && w.stream.Next() {
+		event := w.stream.Event()
+		depth := w.stream.Depth()
+
+		if w.skipping {
+			if event.Type != EndElement || depth != w.skipDepth || event.Name != w.skipName {
+				continue
+			}
+			w.skipping = false
+		}
+
+		var err error
+		switch event.Type {
+		case StartElement:
+			err = w.handler.StartElement(event)
+		case EndElement:
+			err = w.handler.EndElement(event)
+		case Text:
+			err = w.handler.Text(event)
+		case Comment:
+			err = w.handler.Comment(event)
+		case ProcessingInstruction:
+			err = w.handler.ProcessingInstruction(event)
+		}
+
+		switch {
+		case err == nil:
+		case err == SkipAll:
+			w.stopped = true
+			return nil
+		case err == SkipElement:
+			switch {
+			case event.Type == StartElement:
+				if !event.SelfClosing {
+					w.skipping, w.skipDepth, w.skipName = true, depth, event.Name
+				}
+			case event.Type == EndElement:
+				w.skipping, w.skipDepth, w.skipName = true, depth-1, event.Parent
+			default:
+				w.skipping, w.skipDepth, w.skipName = true, depth, event.Parent
+			}
+		default:
+			return err
+		}
+	}
+
+	if w.stopped {
+		return nil
+	}
+
+	return w.stream.Err()
+}
@@ -0,0 +1,130 @@
+package flexml
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var errTest = errors.New("test error")
+
+// recordingHandler records the events it receives and returns the error
+// configured for an element or text
+type recordingHandler struct {
+	BaseHandler
+	events []string
+	errs   map[string]error
+}
+
+func (h *recordingHandler) StartElement(event *Event) error {
+	h.events = append(h.events, "<"+event.Name+">")
+	return h.errs["<"+event.Name+">"]
+}
+
+func (h *recordingHandler) EndElement(event *Event) error {
+	h.events = append(h.events, "</"+event.Name+">")
+	return h.errs["</"+event.Name+">"]
+}
+
+func (h *recordingHandler) Text(event *Event) error {
+	h.events = append(h.events, event.Text)
+	return h.errs[event.Text]
+}
+
+func TestWalk(t *testing.T) {
+	xml := `<a><b>one<c>two</c></b><!-- note --><d>three</d></a>`
+
+	tests := []struct {
+		name     string
+		errs     map[string]error
+		expected string
+		err      error
+	}{
+		{
+			name:     "All events",
+			expected: "<a>,<b>,one,<c>,two,</c>,</b>,<d>,three,</d>,</a>",
+		},
+		{
+			name:     "Skip element from start",
+			errs:     map[string]error{"<b>": SkipElement},
+			expected: "<a>,<b>,</b>,<d>,three,</d>,</a>",
+		},
+		{
+			name:     "Skip rest of parent from text",
+			errs:     map[string]error{"one": SkipElement},
+			expected: "<a>,<b>,one,</b>,<d>,three,</d>,</a>",
+		},
+		{
+			name:     "Skip rest of parent from end",
+			errs:     map[string]error{"</b>": SkipElement},
+			expected: "<a>,<b>,one,<c>,two,</c>,</b>,</a>",
+		},
+		{
+			name:     "Skip all",
+			errs:     map[string]error{"</c>": SkipAll},
+			expected: "<a>,<b>,one,<c>,two,</c>",
+		},
+		{
+			name:     "Handler error",
+			errs:     map[string]error{"two": errTest},
+			expected: "<a>,<b>,one,<c>,two",
+			err:      errTest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &recordingHandler{errs: test.errs}
+
+			err := Walk(strings.NewReader(xml), h)
+			if err != test.err {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+
+			if got := strings.Join(h.events, ","); got != test.expected {
+				t.Errorf("Expected events %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestWalkStream(t *testing.T) {
+	stream := NewStream(WithTextDeltas())
+	stream.WriteString(`<answer>Hello <b/>world`)
+	stream.Close()
+
+	h := &recordingHandler{}
+	if err := WalkStream(stream, h); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := "<answer>,Hello ,<b>,world,</answer>"
+	if got := strings.Join(h.events, ","); got != expected {
+		t.Errorf("Expected events %s, got %s", expected, got)
+	}
+}
+
+func TestWalkerChunks(t *testing.T) {
+	chunks := []string{`<response><think>secret `, `plan</think><answer>4`, `2</answer><extra>`, `more</extra></response>`}
+
+	h := &recordingHandler{errs: map[string]error{"<think>": SkipElement, "</answer>": SkipAll}}
+	stream := NewStream()
+	walker := NewWalker(stream, h)
+
+	for _, chunk := range chunks {
+		stream.WriteString(chunk)
+		if err := walker.Walk(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	stream.Close()
+	if err := walker.Walk(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := "<response>,<think>,</think>,<answer>,42,</answer>"
+	if got := strings.Join(h.events, ","); got != expected {
+		t.Errorf("Expected events %s, got %s", expected, got)
+	}
+}
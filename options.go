@@ -0,0 +1,180 @@
+package flexml
+
+import (
+	"slices"
+	"strings"
+)
+
+// Option configures how input is parsed
+type Option func(*options)
+
+// options holds the settings applied by Option values
+type options struct {
+	maxBufferSize      int
+	preserveWhitespace bool
+	textDeltas         bool
+	strict             bool
+	endTagRecovery     EndTagRecovery
+	implicitClose      map[string][]string // Names of the open elements closed by the start tag of each name
+	rawText            []string            // Names of the elements whose content is read verbatim
+	knownTags          []string            // Names of the only elements recognized as markup, if set
+	diagnosticLimit    int                 // Maximum number of diagnostics kept, if set
+	emitDepth          int                 // Depth of the elements returned by ReadNode
+	emitPath           []string            // Path of the elements returned by ReadNode, if set
+}
+
+// newOptions applies the given options to the defaults
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithMaxBufferSize limits how many bytes a Stream may buffer for a single
+// token that is still incomplete. A token that grows beyond the limit stops
+// the stream with a *TokenTooLargeError. A size of 0 means no limit.
+func WithMaxBufferSize(size int) Option {
+	return func(o *options) {
+		o.maxBufferSize = size
+	}
+}
+
+// WithPreserveWhitespace makes Text events carry the exact bytes of the input,
+// including leading whitespace and runs of whitespace between tags, which are
+// skipped by default. Concatenating the events then reproduces the text of
+// the input exactly.
+func WithPreserveWhitespace() Option {
+	return func(o *options) {
+		o.preserveWhitespace = true
+	}
+}
+
+// WithTextDeltas makes a Stream report text as soon as it arrives. Every
+// piece of text is delivered once in a TextDelta event, and when the run of
+// text ends, at the next tag or at the end of the input, a Text event with
+// the complete run follows. Consumers should handle either TextDelta or Text
+// events, not both.
+func WithTextDeltas() Option {
+	return func(o *options) {
+		o.textDeltas = true
+	}
+}
+
+// WithStrict makes Parse and Stream reject input that is not well-formed
+// XML instead of recovering from it. The first problem that would otherwise
+// be recorded as a Diagnostic stops parsing with a *ParseError, as do stray
+// '&' characters, '<' in attribute values and content outside a single root
+// element. A '<' followed
+// by whitespace, as in "< a>", is reported as a stray '<'.
+func WithStrict() Option {
+	return func(o *options) {
+		o.strict = true
+	}
+}
+
+// EndTagRecovery selects how an end tag that does not match the innermost
+// open element is handled
+type EndTagRecovery int
+
+const (
+	// CloseToMatchingElement closes the open elements up to the nearest one
+	// with the same name. An end tag without any matching open element is
+	// ignored. This is the default.
+	CloseToMatchingElement EndTagRecovery = iota
+	// IgnoreEndTag ignores the end tag
+	IgnoreEndTag
+	// EndTagAsText keeps the end tag as literal text
+	EndTagAsText
+)
+
+// WithEndTagRecovery selects how Parse and Stream handle an end tag that does
+// not match the innermost open element. Every recovery is recorded as a
+// Diagnostic.
+func WithEndTagRecovery(recovery EndTagRecovery) Option {
+	return func(o *options) {
+		o.endTagRecovery = recovery
+	}
+}
+
+// WithImplicitClose makes the start tag of an element named name close the
+// open elements named in closes, together with the elements inside them,
+// before the new element starts. For example WithImplicitClose("answer",
+// "think") starts an answer after the thinking even if </think> is missing,
+// and WithImplicitClose("item", "item") keeps items from nesting. The option
+// can be given several times. Parse and Stream record every implicitly
+// closed element as a Diagnostic. The rules do not apply in strict mode.
+func WithImplicitClose(name string, closes ...string) Option {
+	return func(o *options) {
+		if o.implicitClose == nil {
+			o.implicitClose = map[string][]string{}
+		}
+		o.implicitClose[name] = append(o.implicitClose[name], closes...)
+	}
+}
+
+// closesOnOpen reports whether the start tag of an element named name closes
+// an open element named open, see WithImplicitClose
+func (o *options) closesOnOpen(name, open string) bool {
+	return !o.strict && slices.Contains(o.implicitClose[name], open)
+}
+
+// WithRawText makes the content of the elements with the given names be read
+// verbatim up to their end tag, like <script> in HTML. Tags, comments and
+// references inside are kept as text, and the text is not trimmed or
+// checked, so GetText returns the exact source. The option can be given
+// several times.
+func WithRawText(names ...string) Option {
+	return func(o *options) {
+		o.rawText = append(o.rawText, names...)
+	}
+}
+
+// isRawText reports whether the content of elements with the given name is
+// read verbatim, see WithRawText
+func (o *options) isRawText(name string) bool {
+	return slices.Contains(o.rawText, name)
+}
+
+// WithKnownTags makes Parse and Stream recognize only start and end tags with
+// the given names as markup. Any other '<' sequence, including other tags,
+// comments and processing instructions, is kept as literal text inside the
+// current element, so a stray <b> or <T> in generated text does not change
+// the tree. Unknown tags are not recorded as diagnostics. The option can be
+// given several times.
+func WithKnownTags(names ...string) Option {
+	return func(o *options) {
+		o.knownTags = append(o.knownTags, names...)
+	}
+}
+
+// WithDiagnosticLimit keeps at most limit diagnostics, so that a long-running
+// Stream on malformed input uses bounded memory. Later problems are only
+// counted, see Stream.DiagnosticCount. A limit of 0 means no limit.
+func WithDiagnosticLimit(limit int) Option {
+	return func(o *options) {
+		o.diagnosticLimit = limit
+	}
+}
+
+// WithEmitDepth makes ElementStreamReader.ReadNode return the elements at the
+// given depth, where 1 means root elements, as soon as each one completes.
+// The elements enclosing them are not kept, so a large document can be
+// processed one element at a time in constant memory.
+func WithEmitDepth(depth int) Option {
+	return func(o *options) {
+		o.emitDepth = depth
+		o.emitPath = nil
+	}
+}
+
+// WithEmitPath is like WithEmitDepth, but selects the elements to return by
+// the names of their enclosing elements and their own name separated by
+// slashes, such as "items/item". A "*" matches any name.
+func WithEmitPath(path string) Option {
+	return func(o *options) {
+		o.emitDepth = 0
+		o.emitPath = strings.Split(path, "/")
+	}
+}
@@ -0,0 +1,171 @@
+package flexml
+
+// Route holds the callbacks for one element name, see Router.Handle. Any of
+// the callbacks may be nil.
+type Route struct {
+	OnOpen  func(attrs map[string]string) // Called when the element starts
+	OnText  func(delta string)            // Called with text as it arrives inside the element
+	OnClose func(node *Node)              // Called with the complete element once it ends
+}
+
+// routerFrame is an element that is open while routing
+type routerFrame struct {
+	name  string
+	route *Route
+	node  *Node // Node being built, if the element is inside a routed element
+}
+
+// Router dispatches streamed XML to callbacks registered per element name.
+// Text is delivered to the innermost open element that has a route, as it
+// arrives, including text inside nested elements without a route. Text
+// outside any routed element goes to the fallback.
+type Router struct {
+	stream   *Stream
+	routes   map[string]*Route
+	fallback func(delta string)
+	frames   []routerFrame
+}
+
+// NewRouter creates a router. The router always parses in delta mode, see
+// WithTextDeltas.
+func NewRouter(opts ...Option) *Router {
+	return &Router{
+		stream: NewStream(append(opts[:len(opts):len(opts)], WithTextDeltas())...),
+		routes: map[string]*Route{},
+	}
+}
+
+// Handle registers the callbacks for elements with the given name
+func (r *Router) Handle(name string, route Route) {
+	r.routes[name] = &route
+}
+
+// Fallback registers the callback for text outside any routed element
+func (r *Router) Fallback(fn func(delta string)) {
+	r.fallback = fn
+}
+
+// AddData feeds more input to the router and calls the callbacks for
+// everything that can be parsed so far. It fails with ErrStreamClosed once
+// EOF has been called.
+func (r *Router) AddData(data []byte) error {
+	_, err := r.Write(data)
+	return err
+}
+
+// Write implements io.Writer, see AddData
+func (r *Router) Write(p []byte) (int, error) {
+	if _, err := r.stream.Write(p); err != nil {
+		return 0, err
+	}
+
+	return len(p), r.dispatch()
+}
+
+// EOF signals the end of the input. Partial tokens are flushed, and elements
+// that are still open are closed.
+func (r *Router) EOF() error {
+	r.stream.EOF()
+	return r.dispatch()
+}
+
+// Close implements io.Closer, see EOF
+func (r *Router) Close() error {
+	return r.EOF()
+}
+
+// dispatch calls the callbacks for the available events
+func (r *Router) dispatch() error {
+	for r.stream.Next() {
+		event := r.stream.Event()
+
+		switch event.Type {
+		case StartElement:
+			r.open(event)
+		case EndElement:
+			// Only an end tag matching the innermost open element closes it
+			if len(r.frames) > 0 && r.frames[len(r.frames)-1].name == event.Name {
+				frame := r.frames[len(r.frames)-1]
+				if frame.node != nil {
+					frame.node.closeWith(event)
+				}
+
+				r.close()
+			}
+		case TextDelta:
+			if route := r.textRoute(); route != nil {
+				if route.OnText != nil {
+					route.OnText(event.Text)
+				}
+			} else if r.fallback != nil {
+				r.fallback(event.Text)
+			}
+		case Text, Comment, ProcessingInstruction:
+			if parent := r.current(); parent != nil {
+				node := newNode(event)
+				node.Parent = parent
+				parent.Children = append(parent.Children, node)
+			}
+		}
+	}
+
+	return r.stream.Err()
+}
+
+// open pushes a started element and calls its OnOpen callback
+func (r *Router) open(event *Event) {
+	frame := routerFrame{
+		name:  event.Name,
+		route: r.routes[event.Name],
+	}
+
+	parent := r.current()
+	if frame.route != nil || parent != nil {
+		frame.node = newNode(event)
+		if parent != nil {
+			frame.node.Parent = parent
+			parent.Children = append(parent.Children, frame.node)
+		}
+	}
+
+	r.frames = append(r.frames, frame)
+
+	if frame.route != nil && frame.route.OnOpen != nil {
+		frame.route.OnOpen(event.Attributes)
+	}
+
+	if event.SelfClosing {
+		r.close()
+	}
+}
+
+// close pops the innermost element and calls its OnClose callback
+func (r *Router) close() {
+	frame := r.frames[len(r.frames)-1]
+	r.frames = r.frames[:len(r.frames)-1]
+
+	if frame.route != nil && frame.route.OnClose != nil {
+		frame.route.OnClose(frame.node)
+	}
+}
+
+// current returns the node of the innermost open element, if it is being
+// built
+func (r *Router) current() *Node {
+	if len(r.frames) == 0 {
+		return nil
+	}
+
+	return r.frames[len(r.frames)-1].node
+}
+
+// textRoute returns the route of the innermost open element that has one
+func (r *Router) textRoute() *Route {
+	for i := len(r.frames) - 1; i >= 0; i-- {
+		if r.frames[i].route != nil {
+			return r.frames[i].route
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package flexml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	input := `Sure.<think>Let me <b>think</b><tool/></think><answer lang="en">The answer is <b>42</b></answer>Done`
+
+	var think, answer, fallback strings.Builder
+	var opened []string
+	var closed []*Node
+
+	router := NewRouter()
+	router.Handle("think", Route{
+		OnText: func(delta string) { think.WriteString(delta) },
+	})
+	router.Handle("answer", Route{
+		OnOpen: func(attrs map[string]string) {
+			opened = append(opened, "answer:"+attrs["lang"])
+		},
+		OnText:  func(delta string) { answer.WriteString(delta + "|") },
+		OnClose: func(node *Node) { closed = append(closed, node) },
+	})
+	router.Handle("tool", Route{
+		OnOpen:  func(attrs map[string]string) { opened = append(opened, "tool") },
+		OnClose: func(node *Node) { closed = append(closed, node) },
+	})
+	router.Fallback(func(delta string) { fallback.WriteString(delta) })
+
+	// Feed the input a few bytes at a time
+	for i := 0; i < len(input); i += 3 {
+		end := min(i+3, len(input))
+		if err := router.AddData([]byte(input[i:end])); err != nil {
+			t.Fatalf("AddData error: %v", err)
+		}
+	}
+
+	if err := router.EOF(); err != nil {
+		t.Fatalf("EOF error: %v", err)
+	}
+
+	if think.String() != "Let me think" {
+		t.Errorf("Expected think text 'Let me think', got %q", think.String())
+	}
+
+	if strings.ReplaceAll(answer.String(), "|", "") != "The answer is 42" {
+		t.Errorf("Expected answer text 'The answer is 42', got %q", answer.String())
+	}
+
+	if strings.Count(answer.String(), "|") < 2 {
+		t.Errorf("Expected answer text in several deltas, got %q", answer.String())
+	}
+
+	if fallback.String() != "Sure.Done" {
+		t.Errorf("Expected fallback text 'Sure.Done', got %q", fallback.String())
+	}
+
+	if strings.Join(opened, ",") != "tool,answer:en" {
+		t.Errorf("Unexpected OnOpen calls: %v", opened)
+	}
+
+	if len(closed) != 2 {
+		t.Fatalf("Expected 2 OnClose calls, got %d", len(closed))
+	}
+
+	if closed[0].Name != "tool" || closed[0].Parent == nil || closed[0].Parent.Name != "think" {
+		t.Errorf("Expected the tool inside think first, got %s", closed[0].String())
+	}
+
+	if closed[1].GetText() != "The answer is 42" || closed[1].Attrs["lang"] != "en" {
+		t.Errorf("Expected the complete answer, got %s", closed[1].String())
+	}
+}
+
+func TestRouterUnclosed(t *testing.T) {
+	var closed *Node
+
+	router := NewRouter()
+	router.Handle("answer", Route{
+		OnClose: func(node *Node) { closed = node },
+	})
+
+	router.Write([]byte("<answer>Partial"))
+	if closed != nil {
+		t.Fatal("Expected OnClose to wait for the end of the element")
+	}
+
+	router.Close()
+	if closed == nil || closed.GetText() != "Partial" {
+		t.Fatalf("Expected OnClose with the partial answer at EOF, got %v", closed)
+	}
+}
@@ -2,8 +2,14 @@
 package flexml
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"iter"
+	"slices"
 	"strings"
+	"sync"
 )
 
 // EventType represents the type of XML event
@@ -20,6 +26,8 @@ const (
 	Comment
 	// ProcessingInstruction represents an XML processing instruction
 	ProcessingInstruction
+	// TextDelta represents newly arrived text, see WithTextDeltas
+	TextDelta
 )
 
 // Event represents an XML parsing event
@@ -29,285 +37,813 @@ type Event struct {
 	Text        string            // Text content, comment, or PI data
 	Attributes  map[string]string // Element attributes
 	SelfClosing bool              // Whether the element is self-closing
+	Implicit    bool              // Whether the event was synthesized rather than read from the input
+	Recovered   bool              // Whether an implicit EndElement closes an element to recover from malformed input
+	Parent      string            // Name of the enclosing element, empty at the top level
+
+	Offset    int // Input offset of the first byte of the event
+	EndOffset int // Input offset just past the last byte of the event
+	Line      int // Line of the first byte, starting at 1
+	Column    int // Column of the first byte, starting at 1
 }
 
-// Stream represents an XML parser that processes input in a streaming fashion
+// TokenTooLargeError is returned by Stream.Err when a single incomplete token
+// outgrows the size set with WithMaxBufferSize
+type TokenTooLargeError struct {
+	Offset int // Input offset at which the token starts
+	Limit  int // Maximum buffer size in bytes
+}
+
+func (e *TokenTooLargeError) Error() string {
+	return fmt.Sprintf("token at offset %d exceeds the maximum buffer size of %d bytes", e.Offset, e.Limit)
+}
+
+// ErrStreamClosed is returned by Stream.Write after the end of the input has
+// been signaled
+var ErrStreamClosed = errors.New("write to closed stream")
+
+// Stream represents an XML parser that processes input in a streaming fashion.
+// It is safe to add data from one goroutine while another reads events.
 type Stream struct {
+	mu           sync.Mutex
 	parser       *parser
 	buffer       []byte
 	position     int
 	currentEvent *Event
 	err          error
+	open         []string // Names of the elements that are still open
+	closing      bool     // Whether the last element in open was closed by the current event
+	opts         options
+	reader       io.Reader // Source that is read on demand, if any
+	readBuf      []byte
+	ctx          context.Context // Stops reads from reader when done, if set
+	readErr      error           // Error that ended reading from reader
 }
 
 // NewStream creates a new XML stream parser
-func NewStream() *Stream {
+func NewStream(opts ...Option) *Stream {
+	o := newOptions(opts)
+
 	return &Stream{
 		parser: &parser{
 			pos:  0,
 			line: 1,
 			col:  1,
+			opts: o,
 		},
 		buffer:   make([]byte, 0),
 		position: 0,
+		opts:     o,
 	}
 }
 
-// AddData adds more data to the stream parser
+// AddData adds more data to the stream parser. The data is copied, so the
+// caller may reuse the slice once AddData returns. Bytes that have already
+// been consumed are dropped from the buffer first. Data added once EOF or
+// Close has been called is ignored; use Write to get ErrStreamClosed instead.
 func (s *Stream) AddData(data []byte) {
-	if len(s.buffer) == 0 {
-		s.buffer = data
-		s.parser.input = s.buffer
-	} else {
-		// Append new data
-		s.buffer = append(s.buffer, data...)
-		// Update parser input
-		s.parser.input = s.buffer
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.parser.eof {
+		return
+	}
+
+	s.addData(data)
+}
+
+// Write adds data to the stream parser, so a Stream can be the destination
+// of io.Copy or io.MultiWriter. It fails with ErrStreamClosed once EOF or
+// Close has been called.
+func (s *Stream) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.parser.eof {
+		return 0, ErrStreamClosed
+	}
+
+	s.addData(data)
+	return len(data), nil
+}
+
+// WriteString is like Write, but takes a string
+func (s *Stream) WriteString(data string) (int, error) {
+	return s.Write([]byte(data))
+}
+
+// addData appends data to the buffer
+func (s *Stream) addData(data []byte) {
+	s.compact()
+	s.buffer = append(s.buffer, data...)
+	s.parser.input = s.buffer
+}
+
+// compact drops the consumed bytes from the front of the buffer
+func (s *Stream) compact() {
+	if s.position == 0 {
+		return
 	}
+
+	n := copy(s.buffer, s.buffer[s.position:])
+	s.buffer = s.buffer[:n]
+	s.parser.base += s.position
+	s.position = 0
+}
+
+// InputOffset returns the input offset of the stream's current position,
+// which is the end of the most recently returned event and the start of the
+// next one. Offsets count all bytes added to the stream.
+func (s *Stream) InputOffset() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.inputOffset()
+}
+
+// inputOffset returns the input offset of the stream's current position
+func (s *Stream) inputOffset() int {
+	return s.parser.base + s.position
+}
+
+// EOF signals that no more data will be added. Tokens held back at the end
+// of the input are then emitted as best-effort events, followed by an
+// implicit EndElement event for every element that is still open.
+func (s *Stream) EOF() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.parser.eof = true
 }
 
-// Next advances to the next event
+// Close is equivalent to EOF, which makes a Stream an io.WriteCloser. It
+// always returns nil.
+func (s *Stream) Close() error {
+	s.EOF()
+	return nil
+}
+
+// Next advances to the next event. It returns false when no complete event
+// is available; a token that is cut off at the end of the data added so far
+// is held back until more data arrives or the input is finalized. A stream
+// created by ParseStream reads from its reader until an event is complete.
 func (s *Stream) Next() bool {
-	if s.err != nil || s.position >= len(s.buffer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.next() {
+			return true
+		}
+
+		if s.reader == nil || s.parser.eof || s.err != nil {
+			return false
+		}
+
+		s.fill()
+	}
+}
+
+// fill reads the next chunk from the underlying reader
+func (s *Stream) fill() {
+	var n int
+	var err error
+	if s.ctx != nil && s.ctx.Done() != nil {
+		n, err = readContext(s.ctx, s.reader, s.readBuf)
+	} else {
+		n, err = s.reader.Read(s.readBuf)
+	}
+
+	if n > 0 {
+		s.addData(s.readBuf[:n])
+	}
+
+	if err == io.EOF {
+		s.parser.eof = true
+	} else if err != nil {
+		// Deliver the tokens received so far, but leave elements open
+		s.parser.eof = true
+		s.readErr = err
+	}
+}
+
+// readContext reads from r into buf, giving up as soon as ctx is done. An
+// abandoned read keeps running in the background, so buf must not be used
+// again after an error.
+func readContext(ctx context.Context, r io.Reader, buf []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		n, err := r.Read(buf)
+		done <- result{n, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.n, res.err
+	case <-ctx.Done():
+		// Keep data that arrived at the same time
+		select {
+		case res := <-done:
+			return res.n, res.err
+		default:
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// next tries to produce the next event from the data buffered so far
+func (s *Stream) next() bool {
+	if s.err != nil {
 		return false
 	}
 
+	// An element stays open for the duration of its end event
+	if s.closing {
+		s.open = s.open[:len(s.open)-1]
+		s.closing = false
+	}
+
+	start, line, col := s.position, s.parser.line, s.parser.col
+	diagnostics := s.parser.recorded()
+
 	s.parser.pos = s.position
 	event, newPos, err := s.parser.nextEvent()
-	s.currentEvent = event
 	s.position = newPos
+
+	if err == errIncomplete {
+		if limit := s.opts.maxBufferSize; limit > 0 && len(s.buffer)-s.position > limit {
+			s.err = &TokenTooLargeError{Offset: s.inputOffset(), Limit: limit}
+		}
+
+		// Wait for more data
+		s.currentEvent = nil
+		return false
+	}
+
+	s.currentEvent = event
 	s.err = err
 
-	return event != nil
+	if event == nil {
+		if s.opts.strict && s.parser.eof && s.err == nil && s.readErr == nil && s.parser.roots == 0 {
+			s.parser.diagnose(MissingRoot, "document has no root element")
+		}
+
+		closed := s.closeOpen()
+		return s.checkStrict() && closed
+	}
+
+	switch event.Type {
+	case StartElement:
+		if slices.ContainsFunc(s.open, func(open string) bool { return s.opts.closesOnOpen(event.Name, open) }) {
+			// Close the innermost element now and read the start tag again
+			s.position, s.parser.line, s.parser.col = start, line, col
+			s.parser.rewindDiagnostics(diagnostics)
+			s.closeInnermost(event, "element '%s' is closed by start tag '%s'", s.open[len(s.open)-1], event.Name)
+			break
+		}
+
+		if len(s.open) == 0 {
+			s.parser.root(event.Offset, event.Line, event.Column)
+		}
+
+		s.open = append(s.open, event.Name)
+		s.closing = event.SelfClosing
+		event.Parent = s.parent(1)
+
+		if !event.SelfClosing && s.opts.isRawText(event.Name) {
+			s.parser.raw = event.Name
+		}
+	case EndElement:
+		// Like Parse, an end tag only closes the innermost open element
+		s.closing = len(s.open) > 0 && s.open[len(s.open)-1] == event.Name
+		if s.closing {
+			event.Parent = s.parent(1)
+			if event.Name == s.parser.raw {
+				s.parser.raw = ""
+			}
+		} else if !s.opts.strict && s.opts.endTagRecovery == CloseToMatchingElement && slices.Contains(s.open, event.Name) {
+			// Close the innermost element now and read the end tag again
+			s.position, s.parser.line, s.parser.col = start, line, col
+			s.parser.rewindDiagnostics(diagnostics)
+			s.closeInnermost(event, "element '%s' is closed by end tag '%s'", s.open[len(s.open)-1], event.Name)
+		} else {
+			event.Parent = s.parent(0)
+			s.strayEndTag(event)
+
+			if !s.opts.strict && s.opts.endTagRecovery == EndTagAsText {
+				event.Type = Text
+				event.Text = string(s.buffer[event.Offset-s.parser.base : event.EndOffset-s.parser.base])
+				event.Name = ""
+				s.parser.deltaText(event)
+			}
+		}
+	default:
+		event.Parent = s.parent(0)
+
+		if len(s.open) == 0 && (event.Type == Text || event.Type == TextDelta) {
+			s.parser.topLevelText(event.Text, event.Offset, event.Line, event.Column)
+		}
+	}
+
+	return s.checkStrict()
+}
+
+// checkStrict stops the stream at the first problem in strict mode
+func (s *Stream) checkStrict() bool {
+	if err := s.parser.strictErr(); err != nil {
+		s.err = err
+		s.currentEvent = nil
+		return false
+	}
+
+	return true
+}
+
+// closeInnermost replaces the current event with an implicit EndElement
+// event for the innermost open element, to recover from malformed input at
+// the position of event. The recovery is recorded with the given message.
+func (s *Stream) closeInnermost(event *Event, format string, args ...any) {
+	s.parser.diagnoseAt(UnclosedElement, event.Offset, event.Line, event.Column, format, args...)
+
+	s.closing = true
+	s.currentEvent = &Event{
+		Type:      EndElement,
+		Name:      s.open[len(s.open)-1],
+		Parent:    s.parent(1),
+		Implicit:  true,
+		Recovered: true,
+		Offset:    event.Offset,
+		EndOffset: event.Offset,
+		Line:      event.Line,
+		Column:    event.Column,
+	}
+}
+
+// strayEndTag records an end tag that does not close any element
+func (s *Stream) strayEndTag(event *Event) {
+	if len(s.open) == 0 {
+		s.parser.diagnoseAt(StrayEndTag, event.Offset, event.Line, event.Column, "end tag '%s' has no open element", event.Name)
+	} else {
+		s.parser.diagnoseAt(StrayEndTag, event.Offset, event.Line, event.Column, "end tag '%s' does not match the open element '%s'", event.Name, s.parent(0))
+	}
+}
+
+// Diagnostics returns a copy of the problems in the input that the stream
+// recovered from so far. The stream keeps them until it is discarded, so on
+// malformed input they grow with the input unless they are limited with
+// WithDiagnosticLimit.
+func (s *Stream) Diagnostics() []Diagnostic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Diagnostic(nil), s.parser.diagnostics...)
+}
+
+// DiagnosticCount returns the number of problems in the input that the
+// stream recovered from so far, including the ones beyond the limit set
+// with WithDiagnosticLimit
+func (s *Stream) DiagnosticCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.parser.recorded()
+}
+
+// appendDiagnostics appends the diagnostics recorded after the first n to dst
+func (s *Stream) appendDiagnostics(dst []Diagnostic, n int) []Diagnostic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append(dst, s.parser.diagnostics[n:]...)
+}
+
+// parent returns the name of the open element that is skip levels above the
+// innermost one, or an empty string at the top level
+func (s *Stream) parent(skip int) string {
+	if i := len(s.open) - 1 - skip; i >= 0 {
+		return s.open[i]
+	}
+	return ""
+}
+
+// Depth returns the number of open elements. During StartElement and
+// EndElement events the element of the event is included.
+func (s *Stream) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.open)
+}
+
+// Path returns the names of the open elements separated by slashes, such as
+// "response/answer". During StartElement and EndElement events the element
+// of the event is included.
+func (s *Stream) Path() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return strings.Join(s.open, "/")
+}
+
+// closeOpen emits an implicit EndElement event for the innermost open
+// element once the input has been finalized and fully consumed
+func (s *Stream) closeOpen() bool {
+	if !s.parser.eof || s.err != nil || s.readErr != nil || len(s.open) == 0 {
+		return false
+	}
+
+	s.closing = true
+	s.parser.diagnose(UnclosedElement, "element '%s' is not closed", s.open[len(s.open)-1])
+	s.currentEvent = &Event{
+		Type:      EndElement,
+		Name:      s.open[len(s.open)-1],
+		Parent:    s.parent(1),
+		Implicit:  true,
+		Offset:    s.inputOffset(),
+		EndOffset: s.inputOffset(),
+		Line:      s.parser.line,
+		Column:    s.parser.col,
+	}
+
+	return true
 }
 
 // Event returns the current event
 func (s *Stream) Event() *Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	return s.currentEvent
 }
 
-// Err returns any error that occurred during parsing
+// Err returns any error that occurred during parsing or reading
 func (s *Stream) Err() error {
-	return s.err
-}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-// Parse parses an XML stream from an io.Reader
-func ParseStream(r io.Reader) (*Stream, error) {
-	stream := NewStream()
+	if s.err != nil {
+		return s.err
+	}
+	return s.readErr
+}
 
-	buf := make([]byte, 4096)
-	for {
-		n, err := r.Read(buf)
-		if n > 0 {
-			stream.AddData(buf[:n])
-		}
-		if err == io.EOF {
-			break
+// Events returns an iterator over the stream's events, equivalent to calling
+// Next and Event in a loop. If the stream stops because of an error, the
+// error is yielded last with a nil event.
+func (s *Stream) Events() iter.Seq2[*Event, error] {
+	return func(yield func(*Event, error) bool) {
+		for s.Next() {
+			if !yield(s.Event(), nil) {
+				return
+			}
 		}
-		if err != nil {
-			return stream, err
+
+		if err := s.Err(); err != nil {
+			yield(nil, err)
 		}
 	}
+}
+
+// ParseStream parses an XML stream from an io.Reader. The reader is consumed
+// lazily as Next needs more data, and the end of the reader finalizes the
+// stream. Read errors are reported by Err; the returned error is always nil.
+func ParseStream(r io.Reader, opts ...Option) (*Stream, error) {
+	stream := NewStream(opts...)
+	stream.reader = r
+	stream.readBuf = make([]byte, 4096)
 
 	return stream, nil
 }
 
-// nextEvent parses the next XML event
+// ParseStreamContext is like ParseStream, but stops reading as soon as the
+// context is done. Tokens received up to then are still delivered, after
+// which Err returns the context's error.
+func ParseStreamContext(ctx context.Context, r io.Reader, opts ...Option) (*Stream, error) {
+	stream, err := ParseStream(r, opts...)
+	stream.ctx = ctx
+
+	return stream, err
+}
+
+// errIncomplete reports that the input ends in the middle of a token that
+// may still grow once more data arrives.
+var errIncomplete = errors.New("incomplete token")
+
+// nextEvent parses the next XML event. If the token at the current position
+// is cut off by the end of the input and more input may follow, the parser
+// is rewound to the start of the token and errIncomplete is returned.
 func (p *parser) nextEvent() (*Event, int, error) {
-	// Skip any whitespace
-	p.skipWhitespace()
+	// Skip any whitespace unless it is part of the text
+	if !p.opts.preserveWhitespace && p.run.Len() == 0 && p.raw == "" {
+		p.skipWhitespace()
+	}
+
+	start, line, col := p.pos, p.line, p.col
+	diagnostics := p.recorded()
+
+	event, err := p.readEvent()
+	if err == errIncomplete || (err != nil && p.needMore()) {
+		// The token is read again once it is complete
+		p.pos, p.line, p.col = start, line, col
+		p.rewindDiagnostics(diagnostics)
+		return nil, p.pos, errIncomplete
+	}
+
+	if event != nil {
+		event.Offset = p.base + start
+		event.EndOffset = p.base + p.pos
+		event.Line = line
+		event.Column = col
+	}
+
+	if p.opts.textDeltas && err == nil {
+		if event != nil && event.Type == Text {
+			p.deltaText(event)
+		} else if p.run.Len() > 0 && (event != nil || p.eof) {
+			// The run of text has ended, so report it before the next token
+			p.pos, p.line, p.col = start, line, col
+			p.rewindDiagnostics(diagnostics)
+			event = &Event{
+				Type:      Text,
+				Text:      p.run.String(),
+				Offset:    p.runStart.Offset,
+				EndOffset: p.base + start,
+				Line:      p.runStart.Line,
+				Column:    p.runStart.Column,
+			}
+			p.run.Reset()
+			p.checkText(event.Text, event.Offset, event.Line, event.Column)
+		}
+	}
+
+	return event, p.pos, err
+}
+
+// deltaText turns a Text event into a TextDelta event in delta mode, and
+// keeps its text for the consolidated event
+func (p *parser) deltaText(event *Event) {
+	if !p.opts.textDeltas {
+		return
+	}
 
+	if p.run.Len() == 0 {
+		p.runStart = *event
+	}
+
+	event.Type = TextDelta
+	p.run.WriteString(event.Text)
+}
+
+// readEvent reads the token at the current position
+func (p *parser) readEvent() (*Event, error) {
 	// Check if we've reached the end of input
 	if p.pos >= len(p.input) {
-		return nil, p.pos, nil
+		return nil, nil
 	}
 
-	// Check for tag start
-	if p.input[p.pos] == '<' {
-		p.advance() // Skip '<'
+	start, line, col := p.pos, p.line, p.col
 
-		// Check what kind of tag we have
-		if p.pos < len(p.input) {
-			switch p.input[p.pos] {
-			case '/': // Closing tag
-				p.advance() // Skip '/'
-				name, err := p.readName()
-				if err != nil {
-					return nil, p.pos, err
-				}
+	// The content of a raw text element is text up to its end tag, which is
+	// read as usual
+	if p.raw != "" {
+		undecided := p.scanRawText(p.raw)
+		if p.pos > start || undecided || p.pos >= len(p.input) {
+			if (p.needMore() || undecided) && !p.opts.textDeltas {
+				return nil, errIncomplete
+			}
 
-				// Skip to end of tag
-				for p.pos < len(p.input) && p.input[p.pos] != '>' {
-					p.advance()
-				}
+			if p.pos > start {
+				return &Event{
+					Type: Text,
+					Text: string(p.input[start:p.pos]),
+				}, nil
+			}
 
-				if p.pos < len(p.input) {
-					p.advance() // Skip '>'
-				}
+			return nil, nil
+		}
+	}
 
-				return &Event{
-					Type: EndElement,
-					Name: name,
-				}, p.pos, nil
+	// Check for tag start
+	markup, incomplete := p.markupAt(p.pos)
+	if incomplete {
+		return nil, errIncomplete
+	}
 
-			case '!': // Comment or DOCTYPE
-				p.advance() // Skip '!'
+	if markup {
+		p.advance() // Skip '<'
 
-				if p.pos+1 < len(p.input) && p.input[p.pos] == '-' && p.input[p.pos+1] == '-' {
-					// Comment
-					p.advance() // Skip first '-'
-					p.advance() // Skip second '-'
+		// Check what kind of tag we have
+		switch p.input[p.pos] {
+		case '/': // Closing tag
+			p.advance() // Skip '/'
+			name, err := p.readName()
+			if err != nil {
+				return p.truncated(start, err)
+			}
 
-					comment, err := p.readUntil("-->")
-					if err != nil {
-						return nil, p.pos, err
-					}
+			p.skipEndTag()
+			if p.needMore() {
+				return nil, errIncomplete
+			}
 
-					return &Event{
-						Type: Comment,
-						Text: comment,
-					}, p.pos, nil
-				} else {
-					// DOCTYPE or other declaration - treat as text for flexibility
-					text := "<!" + p.readUntilChar('>')
-					if p.pos < len(p.input) {
-						text += string(p.input[p.pos])
-						p.advance() // Skip '>'
-					}
+			if p.pos < len(p.input) {
+				p.advance() // Skip '>'
+			}
 
-					return &Event{
-						Type: Text,
-						Text: text,
-					}, p.pos, nil
-				}
+			return &Event{
+				Type: EndElement,
+				Name: name,
+			}, nil
 
-			case '?': // Processing instruction
-				p.advance() // Skip '?'
+		case '!': // Comment or DOCTYPE
+			p.advance() // Skip '!'
 
-				target, err := p.readName()
-				if err != nil {
-					return nil, p.pos, err
-				}
+			if p.pos+1 < len(p.input) && p.input[p.pos] == '-' && p.input[p.pos+1] == '-' {
+				// Comment
+				p.advance() // Skip first '-'
+				p.advance() // Skip second '-'
 
-				// Read PI data
-				data, err := p.readUntil("?>")
+				comment, err := p.readUntil("-->")
 				if err != nil {
-					return nil, p.pos, err
+					if !p.eof {
+						return nil, err
+					}
+					p.diagnoseAt(UnterminatedComment, p.base+start, line, col, "comment is not terminated")
 				}
 
 				return &Event{
-					Type: ProcessingInstruction,
-					Name: target,
-					Text: data,
-				}, p.pos, nil
+					Type: Comment,
+					Text: comment,
+				}, nil
+			} else {
+				// DOCTYPE or other declaration - treat as text for flexibility
+				text := "<!" + p.readUntilChar('>')
+				if p.needMore() {
+					return nil, errIncomplete
+				}
 
-			default: // Opening tag
-				name, err := p.readName()
-				if err != nil {
-					return nil, p.pos, err
+				if p.pos < len(p.input) {
+					text += string(p.input[p.pos])
+					p.advance() // Skip '>'
 				}
 
-				attrs := make(map[string]string)
+				return &Event{
+					Type: Text,
+					Text: text,
+				}, nil
+			}
 
-				// Parse attributes
-				for p.pos < len(p.input) && p.input[p.pos] != '>' && p.input[p.pos] != '/' {
-					p.skipWhitespace()
+		case '?': // Processing instruction
+			p.advance() // Skip '?'
 
-					if p.pos < len(p.input) && p.input[p.pos] != '>' && p.input[p.pos] != '/' {
-						attrName, attrValue, err := p.readAttribute()
-						if err != nil {
-							// Treat malformed attribute as end of attributes
-							break
-						}
+			target, err := p.readName()
+			if err != nil {
+				return p.truncated(start, err)
+			}
 
-						attrs[attrName] = attrValue
-					}
+			// Read PI data
+			data, err := p.readUntil("?>")
+			if err != nil {
+				if !p.eof {
+					return nil, err
 				}
+				p.diagnoseAt(UnterminatedProcessingInstruction, p.base+start, line, col, "processing instruction is not terminated")
+			}
 
-				// Check for self-closing tag
-				selfClosing := false
-				if p.pos < len(p.input) && p.input[p.pos] == '/' {
-					selfClosing = true
-					p.advance() // Skip '/'
-				}
+			return &Event{
+				Type: ProcessingInstruction,
+				Name: target,
+				Text: data,
+			}, nil
+
+		default: // Opening tag
+			name, err := p.readName()
+			if err != nil {
+				return p.truncated(start, err)
+			}
 
-				// Skip to end of tag
-				if p.pos < len(p.input) && p.input[p.pos] == '>' {
-					p.advance() // Skip '>'
-				}
+			attrs := p.readAttributes()
 
-				return &Event{
-					Type:        StartElement,
-					Name:        name,
-					Attributes:  attrs,
-					SelfClosing: selfClosing,
-				}, p.pos, nil
+			// Check for self-closing tag
+			selfClosing := false
+			if p.pos < len(p.input) && p.input[p.pos] == '/' {
+				selfClosing = true
+				p.advance() // Skip '/'
 			}
-		} else {
-			// End of input after '<', treat as text
+
+			// A tag cut off before its '>' may still gain attributes
+			if p.needMore() {
+				return nil, errIncomplete
+			}
+
+			// Skip to end of tag
+			if p.pos < len(p.input) && p.input[p.pos] == '>' {
+				p.advance() // Skip '>'
+			}
+
 			return &Event{
-				Type: Text,
-				Text: "<",
-			}, p.pos, nil
+				Type:        StartElement,
+				Name:        name,
+				Attributes:  attrs,
+				SelfClosing: selfClosing,
+			}, nil
 		}
 	} else {
 		// Text content
-		text := p.readUntilChar('<')
+		undecided := p.scanText()
+
+		// Text running into the end of the input may continue in the next
+		// chunk, unless it is delivered piece by piece
+		if (p.needMore() || undecided) && !p.opts.textDeltas {
+			return nil, errIncomplete
+		}
+
+		text := string(p.input[start:p.pos])
+
+		if !p.opts.textDeltas {
+			p.checkText(text, p.base+start, line, col)
+		}
 
 		if text != "" {
 			return &Event{
 				Type: Text,
 				Text: text,
-			}, p.pos, nil
+			}, nil
 		}
 	}
 
-	return nil, p.pos, nil
+	return nil, nil
+}
+
+// truncated handles a failure to read a name. If the final input ends before
+// the name does, the bytes from start are kept as text.
+func (p *parser) truncated(start int, err error) (*Event, error) {
+	if p.eof && p.pos >= len(p.input) && !p.opts.strict {
+		return &Event{
+			Type: Text,
+			Text: string(p.input[start:p.pos]),
+		}, nil
+	}
+
+	return nil, err
 }
 
 // NewElementStreamReader creates a new reader for XML stream events
-func NewElementStreamReader(r io.Reader) *ElementStreamReader {
-	stream := NewStream()
+func NewElementStreamReader(r io.Reader, opts ...Option) *ElementStreamReader {
+	stream, _ := ParseStream(r, opts...)
 
 	return &ElementStreamReader{
-		reader: r,
 		stream: stream,
-		buffer: make([]byte, 4096),
 	}
 }
 
 // ElementStreamReader reads XML and produces events
 type ElementStreamReader struct {
-	reader      io.Reader
 	stream      *Stream
-	buffer      []byte
 	currentNode *Node
 	stack       []*Node
-	eof         bool
+	topLevel    bool // Also return text, comments and PIs outside of elements
 }
 
-// ReadNode reads the next complete XML node
-func (e *ElementStreamReader) ReadNode() (*Node, error) {
-	// If we haven't loaded any data yet, read the first chunk
-	if len(e.stream.buffer) == 0 && !e.eof {
-		if err := e.readMoreData(); err != nil && err != io.EOF {
-			return nil, err
-		}
-	}
+// ReadNodeContext is like ReadNode, but stops reading as soon as the context
+// is done. It then returns the partially built node, if any, along with the
+// context's error, which all later calls return as well.
+func (e *ElementStreamReader) ReadNodeContext(ctx context.Context) (*Node, error) {
+	e.stream.ctx = ctx
+	defer func() {
+		e.stream.ctx = nil
+	}()
 
+	return e.ReadNode()
+}
+
+// ReadNode reads the next complete XML node. Data is read from the
+// underlying reader only as needed to complete the node. If reading fails,
+// the partially built node, if any, is returned along with the error. Root
+// elements are returned unless WithEmitDepth or WithEmitPath is used.
+func (e *ElementStreamReader) ReadNode() (*Node, error) {
 	// Loop through events to build a complete node
 	for e.stream.Next() {
 		event := e.stream.Event()
 
 		switch event.Type {
 		case StartElement:
-			node := &Node{
-				Type:     ElementNode,
-				Name:     event.Name,
-				Children: []*Node{},
-				Attrs:    event.Attributes,
+			if len(e.stack) == 0 && !e.emits() {
+				// Elements enclosing the ones to return are not kept
+				continue
 			}
 
+			node := newNode(event)
+
 			if len(e.stack) == 0 {
 				// This is a root node
 				if event.SelfClosing {
@@ -328,7 +864,10 @@ func (e *ElementStreamReader) ReadNode() (*Node, error) {
 			}
 
 		case EndElement:
-			if len(e.stack) > 0 {
+			// Only an end tag matching the innermost open element closes it
+			if len(e.stack) > 0 && e.stack[len(e.stack)-1].Name == event.Name {
+				e.stack[len(e.stack)-1].closeWith(event)
+
 				// Pop the stack
 				e.stack = e.stack[:len(e.stack)-1]
 
@@ -340,82 +879,119 @@ func (e *ElementStreamReader) ReadNode() (*Node, error) {
 				}
 			}
 
-		case Text:
-			if len(e.stack) > 0 {
-				parent := e.stack[len(e.stack)-1]
-				textNode := &Node{
-					Type:   TextNode,
-					Value:  event.Text,
-					Parent: parent,
-				}
-				parent.Children = append(parent.Children, textNode)
-			}
-
-		case Comment:
-			if len(e.stack) > 0 {
-				parent := e.stack[len(e.stack)-1]
-				commentNode := &Node{
-					Type:   CommentNode,
-					Value:  event.Text,
-					Parent: parent,
-				}
-				parent.Children = append(parent.Children, commentNode)
-			}
-
-		case ProcessingInstruction:
-			if len(e.stack) > 0 {
-				parent := e.stack[len(e.stack)-1]
-				piNode := &Node{
-					Type:   ProcessingInstructionNode,
-					Name:   event.Name,
-					Value:  event.Text,
-					Parent: parent,
-				}
-				parent.Children = append(parent.Children, piNode)
-			}
-		}
-
-		// Check if we need more data
-		if !e.eof && e.stream.position >= len(e.stream.buffer)-1024 {
-			if err := e.readMoreData(); err != nil && err != io.EOF {
-				return nil, err
+		case Text, Comment, ProcessingInstruction:
+			node := newNode(event)
+			if e.addLeaf(node) {
+				return node, nil
 			}
 		}
 	}
 
-	// If we have a current node but hit the end of input, return it anyway
-	if e.currentNode != nil {
+	if err := e.stream.Err(); err != nil {
 		result := e.currentNode
 		e.currentNode = nil
 		e.stack = nil
-		return result, nil
+		return result, err
 	}
 
-	// Check if we need more data and haven't reached EOF
-	if !e.eof {
-		if err := e.readMoreData(); err != nil {
+	return nil, io.EOF
+}
+
+// Nodes returns an iterator over the complete nodes read from r, as returned
+// by ElementStreamReader.ReadNode. If reading fails, the error is yielded
+// last along with the partially built node, if any.
+func Nodes(r io.Reader, opts ...Option) iter.Seq2[*Node, error] {
+	return func(yield func(*Node, error) bool) {
+		reader := NewElementStreamReader(r, opts...)
+
+		for {
+			node, err := reader.ReadNode()
 			if err == io.EOF {
-				e.eof = true
-				return nil, io.EOF
+				return
+			}
+			if !yield(node, err) || err != nil {
+				return
 			}
-			return nil, err
 		}
-		return e.ReadNode()
+	}
+}
+
+// emits reports whether the element of the current StartElement event is
+// one that ReadNode returns, see WithEmitDepth and WithEmitPath
+func (e *ElementStreamReader) emits() bool {
+	opts := e.stream.opts
+
+	if opts.emitPath == nil {
+		return e.stream.Depth() == max(opts.emitDepth, 1)
 	}
 
-	return nil, io.EOF
+	path := strings.Split(e.stream.Path(), "/")
+	if len(path) != len(opts.emitPath) {
+		return false
+	}
+
+	for i, name := range opts.emitPath {
+		if name != "*" && name != path[i] {
+			return false
+		}
+	}
+
+	return true
 }
 
-// ReadMoreData reads more data from the underlying reader
-func (e *ElementStreamReader) readMoreData() error {
-	n, err := e.reader.Read(e.buffer)
-	if n > 0 {
-		e.stream.AddData(e.buffer[:n])
+// newNode creates the node for a StartElement, Text, Comment or
+// ProcessingInstruction event
+func newNode(event *Event) *Node {
+	switch event.Type {
+	case StartElement:
+		node := &Node{
+			Type:     ElementNode,
+			Name:     event.Name,
+			Children: []*Node{},
+			Attrs:    event.Attributes,
+		}
+
+		node.setStart(event.Offset, event.EndOffset)
+		if event.SelfClosing {
+			node.setEnd(event.EndOffset, event.EndOffset)
+			node.Closure = ClosedBySelfClosingTag
+		}
+
+		return node
+	case Comment:
+		return &Node{
+			Type:  CommentNode,
+			Value: event.Text,
+			Span:  Span{Start: event.Offset, End: event.EndOffset},
+		}
+	case ProcessingInstruction:
+		return &Node{
+			Type:  ProcessingInstructionNode,
+			Name:  event.Name,
+			Value: event.Text,
+			Span:  Span{Start: event.Offset, End: event.EndOffset},
+		}
+	default:
+		return &Node{
+			Type:  TextNode,
+			Value: event.Text,
+			Span:  Span{Start: event.Offset, End: event.EndOffset},
+		}
 	}
-	if err == io.EOF {
-		e.eof = true
+}
+
+// addLeaf adds a text, comment or PI node to the current element. It reports
+// whether the node is outside of any element and should be returned as is.
+func (e *ElementStreamReader) addLeaf(node *Node) bool {
+	if len(e.stack) == 0 {
+		return e.topLevel && e.stream.Depth() == 0
 	}
-	return err
+
+	parent := e.stack[len(e.stack)-1]
+	node.Parent = parent
+	parent.Children = append(parent.Children, node)
+
+	return false
 }
 
 // NewStreamDocument creates a new StreamDocument to collect XML nodes
@@ -427,7 +1003,19 @@ func NewStreamDocument() *StreamDocument {
 
 // StreamDocument represents a collection of streamed XML nodes
 type StreamDocument struct {
-	Nodes []*Node
+	Nodes       []*Node
+	Diagnostics []Diagnostic // Problems in the input that parsing recovered from
+}
+
+// Incomplete returns the elements of the document that were not closed by an
+// end tag or a self-closing tag, in document order
+func (d *StreamDocument) Incomplete() []*Node {
+	var result []*Node
+	for _, node := range d.Nodes {
+		result = append(result, node.Incomplete()...)
+	}
+
+	return result
 }
 
 // AddNode adds a node to the document
@@ -446,6 +1034,20 @@ func (d *StreamDocument) DeepFind(name string) ([]*Node, bool) {
 	return result, len(result) > 0
 }
 
+// NodeAt returns the innermost node whose source contains the given input
+// offset
+func (d *StreamDocument) NodeAt(offset int) (*Node, bool) {
+	for _, node := range d.Nodes {
+		if node.Span.Contains(offset) {
+			if inner, ok := node.NodeAt(offset); ok {
+				return inner, true
+			}
+			return node, true
+		}
+	}
+	return nil, false
+}
+
 // FindOne finds the first node with the given name
 func (d *StreamDocument) FindOne(name string) (*Node, bool) {
 	nodes, found := d.DeepFind(name)
@@ -467,131 +1069,36 @@ func (d *StreamDocument) String() string {
 	return sb.String()
 }
 
-// ParseReader parses XML from an io.Reader and returns a StreamDocument
-func ParseReader(r io.Reader) (*StreamDocument, error) {
-	// Create a raw stream for more direct processing of events
-	stream, err := ParseStream(r)
-	if err != nil {
-		return nil, err
-	}
-
-	doc := NewStreamDocument()
-
-	// For root-level nodes we'll collect text and elements directly
-	var currentNode *Node = nil
-
-	for stream.Next() {
-		event := stream.Event()
-
-		switch event.Type {
-		case StartElement:
-			// Create a new node
-			node := &Node{
-				Type:     ElementNode,
-				Name:     event.Name,
-				Children: []*Node{},
-				Attrs:    event.Attributes,
-			}
-
-			if currentNode == nil {
-				// This is a root node
-				if !event.SelfClosing {
-					// Process this node and its children fully
-					subReader := strings.NewReader("") // Empty reader
-					subStream := NewElementStreamReader(subReader)
-					subStream.currentNode = node    // Set this as the current node
-					subStream.stack = []*Node{node} // Start with this node on the stack
-
-					// Manually process remaining events until this element closes
-					depth := 1
-					for stream.Next() && depth > 0 {
-						subEvent := stream.Event()
-
-						switch subEvent.Type {
-						case StartElement:
-							subNode := &Node{
-								Type:     ElementNode,
-								Name:     subEvent.Name,
-								Children: []*Node{},
-								Attrs:    subEvent.Attributes,
-								Parent:   node,
-							}
-
-							node.Children = append(node.Children, subNode)
-							if !subEvent.SelfClosing {
-								node = subNode // Navigate down
-								depth++
-							}
-
-						case EndElement:
-							if depth > 1 {
-								// Find parent
-								parent := node.Parent
-								node = parent // Navigate up
-							}
-							depth--
-
-						case Text:
-							textNode := &Node{
-								Type:   TextNode,
-								Value:  subEvent.Text,
-								Parent: node,
-							}
-							node.Children = append(node.Children, textNode)
-
-						case Comment:
-							commentNode := &Node{
-								Type:   CommentNode,
-								Value:  subEvent.Text,
-								Parent: node,
-							}
-							node.Children = append(node.Children, commentNode)
-
-						case ProcessingInstruction:
-							piNode := &Node{
-								Type:   ProcessingInstructionNode,
-								Name:   subEvent.Name,
-								Value:  subEvent.Text,
-								Parent: node,
-							}
-							node.Children = append(node.Children, piNode)
-						}
-					}
+// ParseReader parses XML from an io.Reader and returns a StreamDocument. The
+// reader is consumed incrementally, so only the resulting nodes are kept in
+// memory. If reading fails, the nodes collected so far are returned along
+// with the error.
+func ParseReader(r io.Reader, opts ...Option) (*StreamDocument, error) {
+	return ParseReaderContext(context.Background(), r, opts...)
+}
 
-					// Add the completed node
-					doc.AddNode(subStream.currentNode)
-				} else {
-					// Self-closing root node
-					doc.AddNode(node)
-				}
-			}
+// ParseReaderContext is like ParseReader, but stops as soon as the context is
+// done. The nodes collected so far, including a partially built one, are
+// returned along with the context's error.
+func ParseReaderContext(ctx context.Context, r io.Reader, opts ...Option) (*StreamDocument, error) {
+	reader := NewElementStreamReader(r, opts...)
+	reader.topLevel = true
 
-		case Text:
-			// Add text as a root node
-			textNode := &Node{
-				Type:  TextNode,
-				Value: event.Text,
-			}
-			doc.AddNode(textNode)
+	doc := NewStreamDocument()
 
-		case Comment:
-			// Add comment as a root node
-			commentNode := &Node{
-				Type:  CommentNode,
-				Value: event.Text,
-			}
-			doc.AddNode(commentNode)
-
-		case ProcessingInstruction:
-			// Add PI as a root node
-			piNode := &Node{
-				Type:  ProcessingInstructionNode,
-				Name:  event.Name,
-				Value: event.Text,
-			}
-			doc.AddNode(piNode)
+	for {
+		node, err := reader.ReadNodeContext(ctx)
+		if node != nil {
+			doc.AddNode(node)
+		}
+		if err != nil {
+			doc.Diagnostics = reader.stream.Diagnostics()
+		}
+		if err == io.EOF {
+			return doc, nil
+		}
+		if err != nil {
+			return doc, err
 		}
 	}
-
-	return doc, nil
 }
@@ -2,9 +2,15 @@ package flexml
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestStreamBasic(t *testing.T) {
@@ -85,6 +91,7 @@ func TestStreamPartialXML(t *testing.T) {
 	}{
 		{StartElement, "key", ""},
 		{Text, "", "Hello"},
+		{EndElement, "key", ""},
 	}
 
 	eventIndex := 0
@@ -216,6 +223,24 @@ func TestElementStreamReader(t *testing.T) {
 	}
 }
 
+func TestParseReaderOneByteReads(t *testing.T) {
+	checkLinear(t, func(size int) (uint64, int) {
+		text := strings.Repeat("x < 5, ", size/7)
+		xml := "<answer>" + text + "</answer>"
+
+		var doc *StreamDocument
+		allocated := allocatedBy(func() {
+			doc, _ = ParseReader(iotest.OneByteReader(strings.NewReader(xml)))
+		})
+
+		if answer, found := doc.FindOne("answer"); !found || answer.GetText() != text {
+			t.Fatalf("Expected the answer text to be read in full")
+		}
+
+		return allocated, 0
+	})
+}
+
 func TestParseReader(t *testing.T) {
 	// Create a new parser for testing directly
 	xml := `<first>Element 1</first><second>Element 2</second>`
@@ -611,3 +636,1055 @@ Since this equals 2 multiplied by an integer, the result must be even.</answer>`
 		t.Errorf("Answer text incomplete: %s", answerText)
 	}
 }
+
+// collectEvents drains all currently available events from the stream
+func collectEvents(stream *Stream) []Event {
+	var events []Event
+	for stream.Next() {
+		events = append(events, *stream.Event())
+	}
+	return events
+}
+
+// withoutPositions clears the source positions of the events, so they can be
+// compared with expectations that only list the content
+func withoutPositions(events []Event) []Event {
+	for i := range events {
+		events[i].Offset, events[i].EndOffset = 0, 0
+		events[i].Line, events[i].Column = 0, 0
+	}
+	return events
+}
+
+func TestStreamChunkBoundaries(t *testing.T) {
+	inputs := []string{
+		`<think>Let me think</think><answer id="1">42</answer>`,
+		`<root attr="a b" other='c'><child/>Text &amp; more</root>`,
+		`<?xml version="1.0"?><!-- a comment --><!DOCTYPE doc><doc>x</doc>`,
+		`Text before <tag>Inside tag</tag> Text after`,
+	}
+
+	for _, input := range inputs {
+		whole := NewStream()
+		whole.AddData([]byte(input))
+		whole.EOF()
+		expected := collectEvents(whole)
+
+		for split := 1; split < len(input); split++ {
+			stream := NewStream()
+			stream.AddData([]byte(input[:split]))
+			events := collectEvents(stream)
+			stream.AddData([]byte(input[split:]))
+			events = append(events, collectEvents(stream)...)
+			stream.EOF()
+			events = append(events, collectEvents(stream)...)
+
+			if !reflect.DeepEqual(events, expected) {
+				t.Errorf("Input %q split at %d: expected %+v, got %+v", input, split, expected, events)
+			}
+		}
+	}
+}
+
+func TestStreamHoldsBackPartialTokens(t *testing.T) {
+	testCases := []string{
+		"<th",
+		"<think attr=\"val",
+		"<!-- comment",
+		"<",
+		"</thi",
+		"<?xml version",
+		"partial text",
+	}
+
+	for _, testCase := range testCases {
+		stream := NewStream()
+		stream.AddData([]byte(testCase))
+
+		if stream.Next() {
+			t.Errorf("Input %q: expected no event before more data, got %+v", testCase, stream.Event())
+		}
+
+		if stream.Err() != nil {
+			t.Errorf("Input %q: unexpected error %v", testCase, stream.Err())
+		}
+	}
+
+	// Once the tag is complete the full name is reported
+	stream := NewStream()
+	stream.AddData([]byte("<th"))
+	stream.Next()
+	stream.AddData([]byte("ink>"))
+
+	if !stream.Next() {
+		t.Fatal("Expected start element once the tag was complete")
+	}
+
+	if event := stream.Event(); event.Type != StartElement || event.Name != "think" {
+		t.Errorf("Expected start of think, got %+v", event)
+	}
+}
+
+func TestElementStreamReaderSmallReads(t *testing.T) {
+	xml := `<root><item id="1">First</item><item id="2">Second</item></root>`
+
+	streamReader := NewElementStreamReader(iotest.OneByteReader(strings.NewReader(xml)))
+
+	node, err := streamReader.ReadNode()
+	if err != nil {
+		t.Fatalf("ReadNode error: %v", err)
+	}
+
+	items, ok := node.FindDeep("item")
+	if !ok || len(items) != 2 {
+		t.Fatalf("Expected 2 items, got %d", len(items))
+	}
+
+	if items[1].GetText() != "Second" {
+		t.Errorf("Expected text 'Second', got '%s'", items[1].GetText())
+	}
+
+	if id, _ := items[1].GetAttribute("id"); id != "2" {
+		t.Errorf("Expected id '2', got '%s'", id)
+	}
+}
+
+func TestStreamEOF(t *testing.T) {
+	stream := NewStream()
+	stream.AddData([]byte("<answer><b>bold</b> partial"))
+
+	events := collectEvents(stream)
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events before EOF, got %d: %+v", len(events), events)
+	}
+
+	if events[3].Type != EndElement || events[3].Name != "b" || events[3].Implicit {
+		t.Errorf("Expected explicit end of b, got %+v", events[3])
+	}
+
+	stream.EOF()
+	events = withoutPositions(collectEvents(stream))
+
+	expected := []Event{
+		{Type: Text, Text: "partial", Parent: "answer"},
+		{Type: EndElement, Name: "answer", Implicit: true},
+	}
+
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %+v after EOF, got %+v", expected, events)
+	}
+}
+
+func TestStreamEOFFlushesPartialTokens(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected []Event
+	}{
+		{"<a><!-- unterminated", []Event{
+			{Type: StartElement, Name: "a", Attributes: map[string]string{}},
+			{Type: Comment, Text: " unterminated", Parent: "a"},
+			{Type: EndElement, Name: "a", Implicit: true},
+		}},
+		{`<a attr="val`, []Event{
+			{Type: StartElement, Name: "a", Attributes: map[string]string{"attr": "val"}},
+			{Type: EndElement, Name: "a", Implicit: true},
+		}},
+		{"<a><?pi data", []Event{
+			{Type: StartElement, Name: "a", Attributes: map[string]string{}},
+			{Type: ProcessingInstruction, Name: "pi", Text: " data", Parent: "a"},
+			{Type: EndElement, Name: "a", Implicit: true},
+		}},
+		{"text <", []Event{
+			{Type: Text, Text: "text <"},
+		}},
+		{"<a></", []Event{
+			{Type: StartElement, Name: "a", Attributes: map[string]string{}},
+			{Type: Text, Text: "</", Parent: "a"},
+			{Type: EndElement, Name: "a", Implicit: true},
+		}},
+	}
+
+	for _, testCase := range testCases {
+		stream := NewStream()
+		stream.AddData([]byte(testCase.input))
+		events := collectEvents(stream)
+		stream.Close()
+		events = withoutPositions(append(events, collectEvents(stream)...))
+
+		if !reflect.DeepEqual(events, testCase.expected) {
+			t.Errorf("Input %q: expected %+v, got %+v", testCase.input, testCase.expected, events)
+		}
+
+		if stream.Err() != nil {
+			t.Errorf("Input %q: unexpected error %v", testCase.input, stream.Err())
+		}
+	}
+}
+
+func TestStreamCompaction(t *testing.T) {
+	stream := NewStream()
+	chunk := []byte("<item id=\"1\">Value</item>")
+	total := 0
+
+	stream.AddData([]byte("<items>"))
+	total += len("<items>")
+	collectEvents(stream)
+
+	for i := 0; i < 1000; i++ {
+		stream.AddData(chunk[:10])
+		stream.AddData(chunk[10:])
+		total += len(chunk)
+
+		events := collectEvents(stream)
+		if len(events) != 3 {
+			t.Fatalf("Chunk %d: expected 3 events, got %d", i, len(events))
+		}
+
+		if events[1].Text != "Value" {
+			t.Fatalf("Chunk %d: expected text 'Value', got '%s'", i, events[1].Text)
+		}
+	}
+
+	if len(stream.buffer) > 2*len(chunk) {
+		t.Errorf("Expected consumed data to be dropped, buffer holds %d bytes", len(stream.buffer))
+	}
+
+	if stream.InputOffset() != total {
+		t.Errorf("Expected input offset %d, got %d", total, stream.InputOffset())
+	}
+}
+
+func TestStreamMaxBufferSize(t *testing.T) {
+	stream := NewStream(WithMaxBufferSize(16))
+	stream.AddData([]byte("<a>ok</a><b attr=\""))
+
+	events := collectEvents(stream)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+
+	stream.AddData([]byte(strings.Repeat("x", 32)))
+
+	if stream.Next() {
+		t.Fatalf("Expected no event, got %+v", stream.Event())
+	}
+
+	var tooLarge *TokenTooLargeError
+	if !errors.As(stream.Err(), &tooLarge) {
+		t.Fatalf("Expected TokenTooLargeError, got %v", stream.Err())
+	}
+
+	if tooLarge.Offset != 9 || tooLarge.Limit != 16 {
+		t.Errorf("Expected offset 9 and limit 16, got %d and %d", tooLarge.Offset, tooLarge.Limit)
+	}
+}
+
+func TestElementStreamReaderIncremental(t *testing.T) {
+	pr, pw := io.Pipe()
+	streamReader := NewElementStreamReader(pr)
+
+	go pw.Write([]byte("<first>Element 1</first><sec"))
+
+	// The first node must be available before the rest of the input
+	node, err := streamReader.ReadNode()
+	if err != nil {
+		t.Fatalf("ReadNode error: %v", err)
+	}
+
+	if node.Name != "first" || node.GetText() != "Element 1" {
+		t.Fatalf("Expected first element, got %s with text '%s'", node.Name, node.GetText())
+	}
+
+	go func() {
+		pw.Write([]byte("ond>Element 2</second>"))
+		pw.Close()
+	}()
+
+	node, err = streamReader.ReadNode()
+	if err != nil {
+		t.Fatalf("ReadNode error: %v", err)
+	}
+
+	if node.Name != "second" || node.GetText() != "Element 2" {
+		t.Fatalf("Expected second element, got %s with text '%s'", node.Name, node.GetText())
+	}
+
+	if _, err = streamReader.ReadNode(); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func TestParseReaderError(t *testing.T) {
+	readErr := errors.New("connection reset")
+	r := io.MultiReader(strings.NewReader("<first>Element 1</first> text <second>"), iotest.ErrReader(readErr))
+
+	doc, err := ParseReader(r)
+	if err != readErr {
+		t.Fatalf("Expected read error, got %v", err)
+	}
+
+	if len(doc.Nodes) != 3 {
+		t.Fatalf("Expected 3 nodes read before the error, got %d", len(doc.Nodes))
+	}
+
+	if doc.Nodes[0].Name != "first" || doc.Nodes[1].Value != "text " || doc.Nodes[2].Name != "second" {
+		t.Errorf("Unexpected nodes: %s", doc.String())
+	}
+}
+
+func TestStreamPreserveWhitespace(t *testing.T) {
+	input := "<a> Hello</a>\n  <b>\n</b> world "
+
+	for split := 0; split <= len(input); split++ {
+		stream := NewStream(WithPreserveWhitespace())
+		stream.AddData([]byte(input[:split]))
+		events := collectEvents(stream)
+		stream.AddData([]byte(input[split:]))
+		events = append(events, collectEvents(stream)...)
+		stream.EOF()
+		events = append(events, collectEvents(stream)...)
+
+		var sb strings.Builder
+		for _, event := range events {
+			switch event.Type {
+			case StartElement:
+				sb.WriteString("<" + event.Name + ">")
+			case EndElement:
+				sb.WriteString("</" + event.Name + ">")
+			case Text:
+				sb.WriteString(event.Text)
+			}
+		}
+
+		if sb.String() != input {
+			t.Errorf("Split at %d: expected %q, got %q", split, input, sb.String())
+		}
+	}
+
+	// Without the option leading whitespace is skipped
+	stream := NewStream()
+	stream.AddData([]byte(input))
+	stream.EOF()
+
+	var texts []string
+	for _, event := range collectEvents(stream) {
+		if event.Type == Text {
+			texts = append(texts, event.Text)
+		}
+	}
+
+	if !reflect.DeepEqual(texts, []string{"Hello", "world "}) {
+		t.Errorf("Expected leading whitespace to be skipped, got %q", texts)
+	}
+}
+
+func TestStreamTextDeltas(t *testing.T) {
+	stream := NewStream(WithTextDeltas())
+
+	chunks := []struct {
+		data     string
+		expected []Event
+	}{
+		{"<answer>Hel", []Event{
+			{Type: StartElement, Name: "answer", Attributes: map[string]string{}},
+			{Type: TextDelta, Text: "Hel", Parent: "answer"},
+		}},
+		{"lo wor", []Event{
+			{Type: TextDelta, Text: "lo wor", Parent: "answer"},
+		}},
+		{"ld</ans", []Event{
+			{Type: TextDelta, Text: "ld", Parent: "answer"},
+		}},
+		{"wer>", []Event{
+			{Type: Text, Text: "Hello world", Parent: "answer"},
+			{Type: EndElement, Name: "answer"},
+		}},
+	}
+
+	for _, chunk := range chunks {
+		stream.AddData([]byte(chunk.data))
+		events := withoutPositions(collectEvents(stream))
+
+		if !reflect.DeepEqual(events, chunk.expected) {
+			t.Errorf("Chunk %q: expected %+v, got %+v", chunk.data, chunk.expected, events)
+		}
+	}
+}
+
+func TestStreamTextDeltasChunking(t *testing.T) {
+	input := `<think>Step one, then two</think><answer>The <b>answer</b> is 42`
+
+	var expectedTexts []string
+	whole := NewStream()
+	whole.AddData([]byte(input))
+	whole.EOF()
+	for _, event := range collectEvents(whole) {
+		if event.Type == Text {
+			expectedTexts = append(expectedTexts, event.Text)
+		}
+	}
+
+	for split := 1; split < len(input); split++ {
+		stream := NewStream(WithTextDeltas())
+		stream.AddData([]byte(input[:split]))
+		events := collectEvents(stream)
+		stream.AddData([]byte(input[split:]))
+		events = append(events, collectEvents(stream)...)
+		stream.EOF()
+		events = append(events, collectEvents(stream)...)
+
+		var texts []string
+		var deltas strings.Builder
+		for _, event := range events {
+			switch event.Type {
+			case Text:
+				texts = append(texts, event.Text)
+			case TextDelta:
+				deltas.WriteString(event.Text)
+			}
+		}
+
+		if !reflect.DeepEqual(texts, expectedTexts) {
+			t.Errorf("Split at %d: expected texts %q, got %q", split, expectedTexts, texts)
+		}
+
+		if deltas.String() != strings.Join(expectedTexts, "") {
+			t.Errorf("Split at %d: expected deltas to add up to %q, got %q", split, strings.Join(expectedTexts, ""), deltas.String())
+		}
+	}
+}
+
+func TestStreamEventPositions(t *testing.T) {
+	input := "<a>\n  <b id=\"1\">text</b>\n</a>"
+
+	// Positions must not depend on chunking or buffer compaction
+	stream := NewStream()
+	var events []Event
+	for i := 0; i < len(input); i++ {
+		stream.AddData([]byte{input[i]})
+		events = append(events, collectEvents(stream)...)
+	}
+	stream.EOF()
+	events = append(events, collectEvents(stream)...)
+
+	expected := []struct {
+		Type      EventType
+		Offset    int
+		EndOffset int
+		Line      int
+		Column    int
+	}{
+		{StartElement, 0, 3, 1, 1},
+		{StartElement, 6, 16, 2, 3},
+		{Text, 16, 20, 2, 13},
+		{EndElement, 20, 24, 2, 17},
+		{EndElement, 25, 29, 3, 1},
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+
+	for i, event := range events {
+		e := expected[i]
+		if event.Type != e.Type || event.Offset != e.Offset || event.EndOffset != e.EndOffset ||
+			event.Line != e.Line || event.Column != e.Column {
+			t.Errorf("Event %d: expected %+v, got %+v", i, e, event)
+		}
+
+		if got := input[event.Offset:event.EndOffset]; event.Type == Text && got != event.Text {
+			t.Errorf("Event %d: offsets cover %q, expected %q", i, got, event.Text)
+		}
+	}
+}
+
+func TestStreamDocumentNodeAt(t *testing.T) {
+	input := `<first>one</first><second><inner>two</inner></second>`
+
+	doc, err := ParseReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseReader error: %v", err)
+	}
+
+	inner, ok := doc.FindOne("inner")
+	if !ok {
+		t.Fatal("Failed to find inner element")
+	}
+
+	if got := input[inner.StartTag.Start:inner.StartTag.End]; got != "<inner>" {
+		t.Errorf("Expected start tag '<inner>', got %q", got)
+	}
+
+	if got := input[inner.Content.Start:inner.Content.End]; got != "two" {
+		t.Errorf("Expected content 'two', got %q", got)
+	}
+
+	if got := input[inner.EndTag.Start:inner.EndTag.End]; got != "</inner>" {
+		t.Errorf("Expected end tag '</inner>', got %q", got)
+	}
+
+	node, ok := doc.NodeAt(strings.Index(input, "two"))
+	if !ok || node.Type != TextNode || node.Parent != inner {
+		t.Errorf("Expected text of inner at offset, got %v", node)
+	}
+
+	node, ok = doc.NodeAt(strings.Index(input, "</second>"))
+	if !ok || node.Name != "second" {
+		t.Errorf("Expected second element at offset, got %v", node)
+	}
+}
+
+func TestStreamPathAndDepth(t *testing.T) {
+	stream := NewStream()
+	stream.AddData([]byte(`<response><answer>42<note/></answer><stray></oops></stray>`))
+	stream.AddData([]byte(`<open>`))
+	stream.EOF()
+
+	expected := []struct {
+		Type   EventType
+		Name   string
+		Parent string
+		Path   string
+		Depth  int
+	}{
+		{StartElement, "response", "", "response", 1},
+		{StartElement, "answer", "response", "response/answer", 2},
+		{Text, "", "answer", "response/answer", 2},
+		{StartElement, "note", "answer", "response/answer/note", 3},
+		{EndElement, "answer", "response", "response/answer", 2},
+		{StartElement, "stray", "response", "response/stray", 2},
+		{EndElement, "oops", "stray", "response/stray", 2},
+		{EndElement, "stray", "response", "response/stray", 2},
+		{StartElement, "open", "response", "response/open", 2},
+		{EndElement, "open", "response", "response/open", 2},
+		{EndElement, "response", "", "response", 1},
+	}
+
+	i := 0
+	for stream.Next() {
+		if i >= len(expected) {
+			t.Fatalf("Too many events, only expected %d", len(expected))
+		}
+
+		event := stream.Event()
+		e := expected[i]
+
+		if event.Type != e.Type || event.Name != e.Name || event.Parent != e.Parent {
+			t.Errorf("Event %d: expected %v %s in %q, got %v %s in %q", i, e.Type, e.Name, e.Parent, event.Type, event.Name, event.Parent)
+		}
+
+		if stream.Path() != e.Path || stream.Depth() != e.Depth {
+			t.Errorf("Event %d: expected path %q at depth %d, got %q at depth %d", i, e.Path, e.Depth, stream.Path(), stream.Depth())
+		}
+
+		i++
+	}
+
+	if i != len(expected) {
+		t.Errorf("Expected %d events, got %d", len(expected), i)
+	}
+
+	if stream.Path() != "" || stream.Depth() != 0 {
+		t.Errorf("Expected no open elements at the end, got %q", stream.Path())
+	}
+}
+
+func TestReadNodeContext(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	go pw.Write([]byte("<first>Element 1</first><second>Partial"))
+
+	streamReader := NewElementStreamReader(pr)
+
+	node, err := streamReader.ReadNodeContext(context.Background())
+	if err != nil || node.Name != "first" {
+		t.Fatalf("Expected first element, got %v (%v)", node, err)
+	}
+
+	// The writer stalls, so the read has to be abandoned
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	node, err = streamReader.ReadNodeContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+
+	if node == nil || node.Name != "second" || node.GetText() != "Partial" {
+		t.Errorf("Expected partial second element, got %v", node)
+	}
+
+	if _, err = streamReader.ReadNode(); err != context.DeadlineExceeded {
+		t.Errorf("Expected the error to persist, got %v", err)
+	}
+}
+
+// stallingReader returns its data and then blocks on further reads until
+// released, calling onStall when the first blocked read starts
+type stallingReader struct {
+	data    io.Reader
+	onStall func()
+	release chan struct{}
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		r.onStall()
+		<-r.release
+	}
+	return n, err
+}
+
+func TestParseReaderContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := &stallingReader{
+		data:    strings.NewReader("<think>Working on it</think><answer>The answer is"),
+		onStall: cancel,
+		release: make(chan struct{}),
+	}
+	defer close(r.release)
+
+	doc, err := ParseReaderContext(ctx, r)
+	if err != context.Canceled {
+		t.Fatalf("Expected context canceled, got %v", err)
+	}
+
+	if len(doc.Nodes) != 2 {
+		t.Fatalf("Expected 2 nodes, got %d", len(doc.Nodes))
+	}
+
+	answer, ok := doc.FindOne("answer")
+	if !ok || answer.GetText() != "The answer is" {
+		t.Errorf("Expected partial answer, got %s", doc.String())
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	xml := `<response><message>Greetings</message></response>`
+
+	stream := NewStream()
+	var copied bytes.Buffer
+
+	// Tee the input so the raw text is kept alongside the parsed events
+	if _, err := io.Copy(stream, io.TeeReader(strings.NewReader(xml), &copied)); err != nil {
+		t.Fatalf("Copy error: %v", err)
+	}
+
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	if _, err := stream.WriteString("<late/>"); err != ErrStreamClosed {
+		t.Errorf("Expected ErrStreamClosed, got %v", err)
+	}
+
+	// AddData ignores late data rather than failing
+	stream.AddData([]byte("<late/>"))
+
+	events := collectEvents(stream)
+	if len(events) != 5 {
+		t.Fatalf("Expected 5 events, got %d", len(events))
+	}
+
+	if events[2].Text != "Greetings" {
+		t.Errorf("Expected text 'Greetings', got '%s'", events[2].Text)
+	}
+
+	if copied.String() != xml {
+		t.Errorf("Expected tee to copy the input, got %q", copied.String())
+	}
+}
+
+func TestStreamConcurrentWrites(t *testing.T) {
+	stream := NewStream()
+
+	go func() {
+		io.WriteString(stream, "<items>")
+		for i := 0; i < 100; i++ {
+			io.WriteString(stream, "<item>value</item>")
+		}
+		io.WriteString(stream, "</items>")
+		stream.Close()
+	}()
+
+	items := 0
+	for stream.Err() == nil {
+		if !stream.Next() {
+			if stream.Depth() == 0 && items > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		if event := stream.Event(); event.Type == StartElement && event.Name == "item" {
+			items++
+		}
+	}
+
+	if items != 100 {
+		t.Errorf("Expected 100 items, got %d", items)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	stream, _ := ParseStream(strings.NewReader(`<a><b>text</b></a>`))
+
+	var names []string
+	for event, err := range stream.Events() {
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if event.Type == StartElement {
+			names = append(names, event.Name)
+		}
+	}
+
+	if strings.Join(names, ",") != "a,b" {
+		t.Errorf("Expected elements a,b, got %s", strings.Join(names, ","))
+	}
+
+	// A read error surfaces at the end of the loop
+	readErr := errors.New("connection reset")
+	stream, _ = ParseStream(io.MultiReader(strings.NewReader("<a>"), iotest.ErrReader(readErr)))
+
+	var lastErr error
+	events := 0
+	for event, err := range stream.Events() {
+		if err != nil {
+			lastErr = err
+			if event != nil {
+				t.Errorf("Expected nil event with the error, got %+v", event)
+			}
+			continue
+		}
+		events++
+	}
+
+	if lastErr != readErr || events != 1 {
+		t.Errorf("Expected 1 event and the read error, got %d and %v", events, lastErr)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	xml := `<item id="1">First</item><item id="2">Second</item>`
+
+	var texts []string
+	for node, err := range Nodes(strings.NewReader(xml)) {
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		texts = append(texts, node.GetText())
+	}
+
+	if strings.Join(texts, ",") != "First,Second" {
+		t.Errorf("Expected First,Second, got %s", strings.Join(texts, ","))
+	}
+}
+
+func TestElementStreamReaderEmitPath(t *testing.T) {
+	xml := `<feed><items>skipped<item id="1">One</item><item id="2"><name>Two</name></item></items><other><item id="3"/></other></feed>`
+
+	tests := []struct {
+		name     string
+		opt      Option
+		expected []string
+	}{
+		{"Depth", WithEmitDepth(3), []string{"1", "2", "3"}},
+		{"Path", WithEmitPath("feed/items/item"), []string{"1", "2"}},
+		{"Wildcard", WithEmitPath("feed/*/item"), []string{"1", "2", "3"}},
+		{"Root", WithEmitDepth(1), []string{""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ids []string
+			for node, err := range Nodes(strings.NewReader(xml), test.opt) {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				if node.Parent != nil {
+					t.Errorf("Expected a detached node, got parent %s", node.Parent.Name)
+				}
+
+				id, _ := node.GetAttribute("id")
+				ids = append(ids, id)
+			}
+
+			if !reflect.DeepEqual(ids, test.expected) {
+				t.Errorf("Expected ids %v, got %v", test.expected, ids)
+			}
+		})
+	}
+}
+
+func TestElementStreamReaderEmitPathIncremental(t *testing.T) {
+	pr, pw := io.Pipe()
+	streamReader := NewElementStreamReader(pr, WithEmitPath("items/item"))
+
+	go pw.Write([]byte("<items><item>One</item><it"))
+
+	// The item must be available while its parent is still open
+	node, err := streamReader.ReadNode()
+	if err != nil {
+		t.Fatalf("ReadNode error: %v", err)
+	}
+
+	if node.GetText() != "One" {
+		t.Fatalf("Expected the first item, got %s", node.String())
+	}
+
+	go func() {
+		pw.Write([]byte("em>Two</item></items>"))
+		pw.Close()
+	}()
+
+	node, err = streamReader.ReadNode()
+	if err != nil || node.GetText() != "Two" {
+		t.Fatalf("Expected the second item, got %v and %v", node, err)
+	}
+
+	if _, err = streamReader.ReadNode(); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func TestReadNodeClosure(t *testing.T) {
+	reader := NewElementStreamReader(strings.NewReader(`<answer>Done</answer><answer>Hello <b>wor`))
+
+	complete, _ := reader.ReadNode()
+	if complete.Closure != ClosedByEndTag || !complete.Complete() {
+		t.Errorf("Expected the first answer to be closed by its end tag, got %d", complete.Closure)
+	}
+
+	truncated, _ := reader.ReadNode()
+	if truncated.Closure != ClosedByEOF || truncated.Complete() {
+		t.Errorf("Expected the second answer to be closed by EOF, got %d", truncated.Closure)
+	}
+
+	if len(truncated.Incomplete()) != 2 {
+		t.Errorf("Expected 2 incomplete elements, got %d", len(truncated.Incomplete()))
+	}
+
+	// Elements cut off by a read error are not closed at all
+	readErr := errors.New("connection reset")
+	doc, _ := ParseReader(io.MultiReader(strings.NewReader("<a/><b><c>"), iotest.ErrReader(readErr)))
+
+	incomplete := doc.Incomplete()
+	if len(incomplete) != 2 || incomplete[0].Closure != NotClosed || incomplete[1].Name != "c" {
+		t.Errorf("Expected b and c to be left open, got %v", incomplete)
+	}
+}
+
+func TestStreamLiteralLessThan(t *testing.T) {
+	input := `<answer>if x < 5 and a <= b, then <3 <?! done</answer><next/>`
+
+	stream := NewStream()
+	stream.AddData([]byte(input))
+	stream.EOF()
+	expected := withoutPositions(collectEvents(stream))
+
+	if len(expected) != 4 || expected[1].Text != "if x < 5 and a <= b, then <3 <?! done" || expected[3].Name != "next" {
+		t.Fatalf("Expected the prose as one text event, got %+v", expected)
+	}
+
+	// Every chunking yields the same events, with or without deltas
+	for _, size := range []int{1, 2, 3, 5} {
+		for _, deltas := range []bool{false, true} {
+			var opts []Option
+			if deltas {
+				opts = append(opts, WithTextDeltas())
+			}
+
+			stream := NewStream(opts...)
+			var events []Event
+			for i := 0; i < len(input); i += size {
+				stream.AddData([]byte(input[i:min(i+size, len(input))]))
+				events = append(events, collectEvents(stream)...)
+			}
+			stream.EOF()
+			events = append(events, collectEvents(stream)...)
+
+			var consolidated []Event
+			for _, event := range withoutPositions(events) {
+				if event.Type != TextDelta {
+					consolidated = append(consolidated, event)
+				}
+			}
+
+			if !reflect.DeepEqual(consolidated, expected) {
+				t.Errorf("Chunk size %d, deltas %v: expected %+v, got %+v", size, deltas, expected, consolidated)
+			}
+
+			if stream.Err() != nil || len(stream.Diagnostics()) != 4 {
+				t.Errorf("Chunk size %d, deltas %v: expected 4 diagnostics and no error, got %v and %v", size, deltas, stream.Diagnostics(), stream.Err())
+			}
+		}
+	}
+}
+
+func TestStreamEndTagRecovery(t *testing.T) {
+	stream := NewStream()
+	stream.AddData([]byte(`<a><b><i>text</a><c/>`))
+	stream.EOF()
+
+	events := withoutPositions(collectEvents(stream))
+	expected := []Event{
+		{Type: StartElement, Name: "a", Attributes: map[string]string{}},
+		{Type: StartElement, Name: "b", Attributes: map[string]string{}, Parent: "a"},
+		{Type: StartElement, Name: "i", Attributes: map[string]string{}, Parent: "b"},
+		{Type: Text, Text: "text", Parent: "i"},
+		{Type: EndElement, Name: "i", Parent: "b", Implicit: true, Recovered: true},
+		{Type: EndElement, Name: "b", Parent: "a", Implicit: true, Recovered: true},
+		{Type: EndElement, Name: "a"},
+		{Type: StartElement, Name: "c", Attributes: map[string]string{}, SelfClosing: true},
+	}
+
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected events:\n%+v\nGot:\n%+v", expected, events)
+	}
+
+	// ReadNode returns the elements as siblings
+	reader := NewElementStreamReader(strings.NewReader(`<a><b>text</a><c/>`))
+
+	a, _ := reader.ReadNode()
+	c, _ := reader.ReadNode()
+	if a.Name != "a" || c == nil || c.Name != "c" {
+		t.Fatalf("Expected a and c as separate nodes, got %v and %v", a, c)
+	}
+
+	if b, _ := a.FindOne("b"); b.Closure != ClosedByRecovery {
+		t.Errorf("Expected b to be closed by recovery, got %d", b.Closure)
+	}
+}
+
+func TestStreamEndTagAsTextDeltas(t *testing.T) {
+	stream := NewStream(WithTextDeltas(), WithEndTagRecovery(EndTagAsText))
+	stream.AddData([]byte(`<a>x</b>y</a>`))
+	stream.EOF()
+
+	var text []string
+	for _, event := range collectEvents(stream) {
+		if event.Type == Text {
+			text = append(text, event.Text)
+		}
+	}
+
+	if !reflect.DeepEqual(text, []string{"x", "</b>y"}) {
+		t.Errorf("Expected the stray end tag in the text, got %q", text)
+	}
+}
+
+func TestStreamImplicitClose(t *testing.T) {
+	input := `<think>x<answer a=1>y</answer>`
+
+	stream := NewStream(WithImplicitClose("answer", "think"))
+	stream.AddData([]byte(input))
+	stream.EOF()
+
+	events := withoutPositions(collectEvents(stream))
+	expected := []Event{
+		{Type: StartElement, Name: "think", Attributes: map[string]string{}},
+		{Type: Text, Text: "x", Parent: "think"},
+		{Type: EndElement, Name: "think", Implicit: true, Recovered: true},
+		{Type: StartElement, Name: "answer", Attributes: map[string]string{"a": "1"}},
+		{Type: Text, Text: "y", Parent: "answer"},
+		{Type: EndElement, Name: "answer"},
+	}
+
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected events:\n%+v\nGot:\n%+v", expected, events)
+	}
+
+	// The attribute is only reported once, although the start tag is read
+	// twice
+	diagnostics := stream.Diagnostics()
+	if len(diagnostics) != 2 || diagnostics[0].Kind != UnclosedElement || diagnostics[1].Kind != BadAttribute {
+		t.Errorf("Expected the implicit close and the attribute, got %v", diagnostics)
+	}
+}
+
+// checkLinear fails unless the cost of parsing grows about linearly with the
+// size of the input. The cost function parses an input of the given size and
+// returns the bytes allocated and the characters the parser advanced over;
+// four times the input may cost up to eight times as much, where quadratic
+// work would cost sixteen times as much.
+func checkLinear(t *testing.T, cost func(size int) (uint64, int)) {
+	t.Helper()
+
+	const size = 1 << 14
+
+	smallAlloc, smallSteps := cost(size)
+	largeAlloc, largeSteps := cost(4 * size)
+
+	if largeAlloc > 8*smallAlloc {
+		t.Errorf("Expected linear allocations, allocated %d bytes for %d bytes and %d bytes for %d bytes", smallAlloc, size, largeAlloc, 4*size)
+	}
+
+	if largeSteps > 8*smallSteps {
+		t.Errorf("Expected linear parsing, advanced %d times for %d bytes and %d times for %d bytes", smallSteps, size, largeSteps, 4*size)
+	}
+}
+
+// allocatedBy returns the bytes allocated while running fn
+func allocatedBy(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestStreamLongTokensInSmallChunks(t *testing.T) {
+	tests := []struct {
+		name                 string
+		prefix, body, suffix string
+		opts                 []Option
+	}{
+		{"Text", "<answer>", "text ", "</answer>", nil},
+		{"Text with stray less-than", "<answer>", "x < 5, ", "</answer>", nil},
+		{"Comment", "<a><!--", "text ", "--></a>", nil},
+		{"Processing instruction", "<a><?pi ", "text ", "?></a>", nil},
+		{"Declaration", "<!DOCTYPE ", "text ", "><a/>", nil},
+		{"Attribute value", `<a x="`, "text ", `"/>`, nil},
+		{"Raw text", "<code>", "a<b> ", "</code>", []Option{WithRawText("code")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkLinear(t, func(size int) (uint64, int) {
+				input := []byte(test.prefix + strings.Repeat(test.body, size/len(test.body)) + test.suffix)
+				doc, _ := Parse(string(input), test.opts...)
+
+				// Feed the input in 4-byte chunks, reading events after each
+				stream := NewStream(test.opts...)
+				allocated := allocatedBy(func() {
+					for i := 0; i < len(input); i += 4 {
+						stream.AddData(input[i:min(i+4, len(input))])
+						for stream.Next() {
+						}
+					}
+					stream.EOF()
+					for stream.Next() {
+					}
+				})
+
+				if stream.Err() != nil {
+					t.Fatalf("Stream error: %v", stream.Err())
+				}
+
+				if !reflect.DeepEqual(stream.Diagnostics(), doc.Diagnostics) {
+					t.Fatalf("Expected %d diagnostics like Parse, got %d", len(doc.Diagnostics), len(stream.Diagnostics()))
+				}
+
+				return allocated, stream.parser.steps
+			})
+		})
+	}
+}
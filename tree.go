@@ -0,0 +1,208 @@
+package flexml
+
+import (
+	"sort"
+	"strings"
+)
+
+// PatchType represents the kind of change described by a Patch
+type PatchType int
+
+const (
+	// PatchOpenElement adds an element named Name to the node Parent
+	PatchOpenElement PatchType = iota
+	// PatchSetAttribute sets the attribute Name of the element to Value
+	PatchSetAttribute
+	// PatchAddText adds a text node with the text Value to the node Parent
+	PatchAddText
+	// PatchAppendText appends Value to the text node
+	PatchAppendText
+	// PatchAddComment adds a comment with the text Value to the node Parent
+	PatchAddComment
+	// PatchAddProcessingInstruction adds a processing instruction with the
+	// target Name and the data Value to the node Parent
+	PatchAddProcessingInstruction
+	// PatchCloseElement marks the element as closed
+	PatchCloseElement
+)
+
+// Patch describes one change that a TreeBuilder made to its document. Nodes
+// are addressed by their ID; the document root has ID 0.
+type Patch struct {
+	Type   PatchType
+	ID     int // Node that was added or changed
+	Parent int // Node a new node was added to
+	Name   string
+	Value  string
+}
+
+// TreeBuilder builds a Document from XML that arrives in pieces. After each
+// piece the document holds everything parsed so far, including the text
+// received so far of elements that are still open. Elements that are still
+// open have the Closure NotClosed. A TreeBuilder is not safe for concurrent use;
+// read the document between calls that feed it.
+type TreeBuilder struct {
+	stream *Stream
+	doc    *Document
+	stack  []*Node         // Open elements, starting with the document root
+	text   *Node           // Text node receiving the current run of text, if any
+	run    strings.Builder // Text of the current run, shared with text.Value
+	seen   int             // Number of the stream's diagnostics already in the document
+	nextID int
+	patch  func(Patch)
+}
+
+// NewTreeBuilder creates a tree builder. The builder always parses in delta
+// mode, see WithTextDeltas.
+func NewTreeBuilder(opts ...Option) *TreeBuilder {
+	root := &Node{
+		Type:     ElementNode,
+		Name:     "root", // Special root node to hold everything
+		Children: []*Node{},
+		Attrs:    map[string]string{},
+	}
+
+	return &TreeBuilder{
+		stream: NewStream(append(opts[:len(opts):len(opts)], WithTextDeltas())...),
+		doc:    &Document{Root: root},
+		stack:  []*Node{root},
+	}
+}
+
+// Document returns the document built so far. The same document is updated
+// in place as more input arrives.
+func (b *TreeBuilder) Document() *Document {
+	return b.doc
+}
+
+// OnPatch registers a callback that receives every change made to the
+// document, in order, as it is made
+func (b *TreeBuilder) OnPatch(fn func(Patch)) {
+	b.patch = fn
+}
+
+// AddData feeds more input to the builder and adds everything that can be
+// parsed so far to the document. It fails with ErrStreamClosed once EOF has
+// been called.
+func (b *TreeBuilder) AddData(data []byte) error {
+	_, err := b.Write(data)
+	return err
+}
+
+// Write implements io.Writer, see AddData
+func (b *TreeBuilder) Write(p []byte) (int, error) {
+	if _, err := b.stream.Write(p); err != nil {
+		return 0, err
+	}
+
+	return len(p), b.build()
+}
+
+// EOF signals the end of the input. Partial tokens are flushed, and elements
+// that are still open are closed.
+func (b *TreeBuilder) EOF() error {
+	b.stream.EOF()
+	return b.build()
+}
+
+// Close implements io.Closer, see EOF
+func (b *TreeBuilder) Close() error {
+	return b.EOF()
+}
+
+// build adds the available events to the document
+func (b *TreeBuilder) build() error {
+	for b.stream.Next() {
+		event := b.stream.Event()
+		parent := b.stack[len(b.stack)-1]
+
+		switch event.Type {
+		case StartElement:
+			node := b.add(parent, newNode(event), PatchOpenElement)
+
+			names := make([]string, 0, len(node.Attrs))
+			for name := range node.Attrs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				b.emit(Patch{Type: PatchSetAttribute, ID: node.ID, Name: name, Value: node.Attrs[name]})
+			}
+
+			if event.SelfClosing {
+				b.emit(Patch{Type: PatchCloseElement, ID: node.ID})
+			} else {
+				b.stack = append(b.stack, node)
+			}
+
+		case EndElement:
+			// Only an end tag matching the innermost open element closes it
+			if len(b.stack) > 1 && parent.Name == event.Name {
+				parent.closeWith(event)
+				b.stack = b.stack[:len(b.stack)-1]
+				b.emit(Patch{Type: PatchCloseElement, ID: parent.ID})
+			}
+
+		case TextDelta:
+			if b.text == nil {
+				b.run.Reset()
+				b.run.WriteString(event.Text)
+				b.text = b.add(parent, newNode(event), PatchAddText)
+			} else {
+				// Appending to the builder does not copy the text so far
+				b.run.WriteString(event.Text)
+				b.text.Value = b.run.String()
+				b.text.Span.End = event.EndOffset
+				b.emit(Patch{Type: PatchAppendText, ID: b.text.ID, Value: event.Text})
+			}
+
+		case Text:
+			// The deltas of the run are already in the document
+			b.text = nil
+
+		case Comment:
+			b.add(parent, newNode(event), PatchAddComment)
+
+		case ProcessingInstruction:
+			b.add(parent, newNode(event), PatchAddProcessingInstruction)
+		}
+	}
+
+	// Elements that are still open extend to the end of the input so far
+	offset := b.stream.InputOffset()
+	for _, node := range b.stack {
+		node.setEnd(offset, offset)
+	}
+
+	b.doc.Diagnostics = b.stream.appendDiagnostics(b.doc.Diagnostics, b.seen)
+	b.seen = len(b.doc.Diagnostics)
+
+	return b.stream.Err()
+}
+
+// add appends a node to the children of parent, assigns its ID and reports
+// the addition with a patch of the given type
+func (b *TreeBuilder) add(parent, node *Node, patchType PatchType) *Node {
+	b.nextID++
+	node.ID = b.nextID
+	node.Parent = parent
+	parent.Children = append(parent.Children, node)
+
+	b.emit(Patch{
+		Type:   patchType,
+		ID:     node.ID,
+		Parent: parent.ID,
+		Name:   node.Name,
+		Value:  node.Value,
+	})
+
+	return node
+}
+
+// emit passes a patch to the OnPatch callback, if any
+func (b *TreeBuilder) emit(patch Patch) {
+	if b.patch != nil {
+		b.patch(patch)
+	}
+}
@@ -0,0 +1,204 @@
+package flexml
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTreeBuilder(t *testing.T) {
+	builder := NewTreeBuilder()
+	doc := builder.Document()
+
+	builder.AddData([]byte(`<answer id="1"><p>Hel`))
+
+	answer, found := doc.FindOne("answer")
+	if !found || answer.Closure != NotClosed || answer.Attrs["id"] != "1" {
+		t.Fatalf("Expected an open answer element, got %v", answer)
+	}
+
+	p, found := doc.FindOne("p")
+	if !found || p.Closure != NotClosed || p.GetText() != "Hel" {
+		t.Fatalf("Expected an open p element with the text so far, got %v", p)
+	}
+
+	if p.Span.End != len(`<answer id="1"><p>Hel`) {
+		t.Errorf("Expected the open element to extend to the input so far, got %d", p.Span.End)
+	}
+
+	builder.AddData([]byte(`lo</p><li`))
+
+	if p.Closure == NotClosed || p.GetText() != "Hello" || len(p.Children) != 1 {
+		t.Errorf("Expected a closed p element with one text node, got %s", p.String())
+	}
+
+	if _, found := doc.FindOne("li"); found {
+		t.Error("Expected the partial li tag to be held back")
+	}
+
+	builder.AddData([]byte(`>x</li><!-- c --></answer><next>`))
+
+	if answer.Closure == NotClosed {
+		t.Error("Expected answer to be closed")
+	}
+
+	next, _ := doc.FindOne("next")
+	if next == nil || next.Closure != NotClosed {
+		t.Fatalf("Expected an open next element, got %v", next)
+	}
+
+	if err := builder.EOF(); err != nil {
+		t.Fatalf("EOF error: %v", err)
+	}
+
+	if next.Closure != ClosedByEOF {
+		t.Error("Expected next to be closed at EOF")
+	}
+
+	if answer.Closure != ClosedByEndTag {
+		t.Errorf("Expected answer to be closed by its end tag, got %d", answer.Closure)
+	}
+
+	expected, _ := Parse(`<answer id="1"><p>Hello</p><li>x</li><!-- c --></answer><next>`)
+	if doc.String() != expected.String() {
+		t.Errorf("Expected document %s, got %s", expected.String(), doc.String())
+	}
+
+	if err := builder.AddData([]byte("<late/>")); err != ErrStreamClosed {
+		t.Errorf("Expected ErrStreamClosed after EOF, got %v", err)
+	}
+}
+
+func TestTreeBuilderChunking(t *testing.T) {
+	input := `<response><think>Step one<br/>step two</think><answer>42</answer></response>`
+	expected, _ := Parse(input)
+
+	builder := NewTreeBuilder()
+	for _, c := range input {
+		if _, err := builder.Write([]byte(string(c))); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+	}
+	builder.Close()
+
+	if got := builder.Document().String(); got != expected.String() {
+		t.Errorf("Expected document %s, got %s", expected.String(), got)
+	}
+
+	think, _ := builder.Document().FindOne("think")
+	if strings.Join([]string{think.Children[0].Value, think.Children[2].Value}, "|") != "Step one|step two" {
+		t.Errorf("Expected text merged across chunks, got %s", think.String())
+	}
+}
+
+func TestTreeBuilderPatches(t *testing.T) {
+	var patches []Patch
+
+	builder := NewTreeBuilder()
+	builder.OnPatch(func(patch Patch) {
+		patches = append(patches, patch)
+	})
+
+	builder.AddData([]byte(`<answer b="2" a="1">Hel`))
+	builder.AddData([]byte(`lo<br/></answer>`))
+	builder.EOF()
+
+	expected := []Patch{
+		{Type: PatchOpenElement, ID: 1, Parent: 0, Name: "answer"},
+		{Type: PatchSetAttribute, ID: 1, Name: "a", Value: "1"},
+		{Type: PatchSetAttribute, ID: 1, Name: "b", Value: "2"},
+		{Type: PatchAddText, ID: 2, Parent: 1, Value: "Hel"},
+		{Type: PatchAppendText, ID: 2, Value: "lo"},
+		{Type: PatchOpenElement, ID: 3, Parent: 1, Name: "br"},
+		{Type: PatchCloseElement, ID: 3},
+		{Type: PatchCloseElement, ID: 1},
+	}
+
+	if !reflect.DeepEqual(patches, expected) {
+		t.Errorf("Expected patches:\n%+v\nGot:\n%+v", expected, patches)
+	}
+
+	answer, _ := builder.Document().FindOne("answer")
+	if answer.ID != 1 || answer.Children[0].ID != 2 {
+		t.Errorf("Expected node IDs to match the patches, got %d and %d", answer.ID, answer.Children[0].ID)
+	}
+}
+
+func TestTreeBuilderPatchReplay(t *testing.T) {
+	input := `<?xml version="1.0"?><doc><!-- c --><a x="1">one<b>two</b>three</a><c/>tail`
+
+	// Rebuild the document from the patches alone
+	nodes := map[int]*Node{0: {Type: ElementNode, Name: "root", Attrs: map[string]string{}}}
+
+	builder := NewTreeBuilder()
+	builder.OnPatch(func(patch Patch) {
+		var node *Node
+
+		switch patch.Type {
+		case PatchOpenElement:
+			node = &Node{Type: ElementNode, Name: patch.Name, Attrs: map[string]string{}}
+		case PatchAddText:
+			node = &Node{Type: TextNode, Value: patch.Value}
+		case PatchAddComment:
+			node = &Node{Type: CommentNode, Value: patch.Value}
+		case PatchAddProcessingInstruction:
+			node = &Node{Type: ProcessingInstructionNode, Name: patch.Name, Value: patch.Value}
+		case PatchSetAttribute:
+			nodes[patch.ID].Attrs[patch.Name] = patch.Value
+		case PatchAppendText:
+			nodes[patch.ID].Value += patch.Value
+		case PatchCloseElement:
+			nodes[patch.ID].Closure = ClosedByEndTag
+		}
+
+		if node != nil {
+			parent := nodes[patch.Parent]
+			node.Parent = parent
+			parent.Children = append(parent.Children, node)
+			nodes[patch.ID] = node
+		}
+	})
+
+	for i := 0; i < len(input); i += 4 {
+		builder.AddData([]byte(input[i:min(i+4, len(input))]))
+	}
+	builder.EOF()
+
+	replica := &Document{Root: nodes[0]}
+	if replica.String() != builder.Document().String() {
+		t.Errorf("Expected replica %s, got %s", builder.Document().String(), replica.String())
+	}
+
+	for id, node := range nodes {
+		if id != 0 && node.Type == ElementNode && node.Closure == NotClosed {
+			t.Errorf("Expected all elements to be closed, %s is open", node.Name)
+		}
+	}
+}
+
+func TestTreeBuilderLongText(t *testing.T) {
+	// Every stray '<' adds a diagnostic
+	checkLinear(t, func(size int) (uint64, int) {
+		text := strings.Repeat("text x < 5 ", size/11)
+		input := []byte("<answer>" + text + "</answer>")
+
+		// Feed the input in 4-byte chunks
+		builder := NewTreeBuilder()
+		allocated := allocatedBy(func() {
+			for i := 0; i < len(input); i += 4 {
+				builder.AddData(input[i:min(i+4, len(input))])
+			}
+			builder.EOF()
+		})
+
+		if answer, _ := builder.Document().FindOne("answer"); answer.GetText() != text {
+			t.Fatalf("Expected the answer text to be built in full")
+		}
+
+		if len(builder.Document().Diagnostics) != size/11 {
+			t.Fatalf("Expected %d diagnostics, got %d", size/11, len(builder.Document().Diagnostics))
+		}
+
+		return allocated, builder.stream.parser.steps
+	})
+}
@@ -2,7 +2,9 @@
 package flexml
 
 import (
-	"fmt"
+	"errors"
+	"iter"
+	"slices"
 	"strings"
 )
 
@@ -20,6 +22,36 @@ const (
 	ProcessingInstructionNode
 )
 
+// Span is the half-open range [Start, End) of input offsets a node was read from
+type Span struct {
+	Start int
+	End   int
+}
+
+// Contains reports whether the offset lies within the span
+func (s Span) Contains(offset int) bool {
+	return offset >= s.Start && offset < s.End
+}
+
+// Closure describes how an element was closed
+type Closure int
+
+const (
+	// NotClosed means the element has not been closed, such as an element
+	// still waiting for its end tag in a TreeBuilder, or the node is not an
+	// element
+	NotClosed Closure = iota
+	// ClosedByEndTag means the element's end tag was read
+	ClosedByEndTag
+	// ClosedBySelfClosingTag means the element was written as <name/>
+	ClosedBySelfClosingTag
+	// ClosedByEOF means the input ended before the element's end tag
+	ClosedByEOF
+	// ClosedByRecovery means the element was closed to recover from
+	// malformed input
+	ClosedByRecovery
+)
+
 // Node represents an XML node
 type Node struct {
 	Type     NodeType
@@ -28,6 +60,13 @@ type Node struct {
 	Children []*Node
 	Attrs    map[string]string
 	Parent   *Node
+	ID       int     // Identifier assigned by TreeBuilder, unique within its document
+	Closure  Closure // How the element was closed
+
+	Span     Span // Source of the whole node
+	StartTag Span // Source of the start tag (elements only)
+	Content  Span // Source between the start and end tags (elements only)
+	EndTag   Span // Source of the end tag, empty if none was seen (elements only)
 }
 
 func (n *Node) FindOne(name string) (*Node, bool) {
@@ -54,18 +93,155 @@ func (n *Node) String() string {
 	return sb.String()
 }
 
+// Descendants returns an iterator over all nodes below the node, in document
+// order
+func (n *Node) Descendants() iter.Seq[*Node] {
+	return func(yield func(*Node) bool) {
+		n.walkDescendants(yield)
+	}
+}
+
+// walkDescendants calls yield for each descendant until it returns false
+func (n *Node) walkDescendants(yield func(*Node) bool) bool {
+	for _, child := range n.Children {
+		if !yield(child) || !child.walkDescendants(yield) {
+			return false
+		}
+	}
+	return true
+}
+
+// Ancestors returns an iterator over the node's parent, its parent, and so on
+// up to the root
+func (n *Node) Ancestors() iter.Seq[*Node] {
+	return func(yield func(*Node) bool) {
+		for parent := n.Parent; parent != nil; parent = parent.Parent {
+			if !yield(parent) {
+				return
+			}
+		}
+	}
+}
+
+// ChildElements returns an iterator over the element children of the node
+func (n *Node) ChildElements() iter.Seq[*Node] {
+	return func(yield func(*Node) bool) {
+		for _, child := range n.Children {
+			if child.Type == ElementNode && !yield(child) {
+				return
+			}
+		}
+	}
+}
+
+// Siblings returns an iterator over the other children of the node's parent
+func (n *Node) Siblings() iter.Seq[*Node] {
+	return func(yield func(*Node) bool) {
+		if n.Parent == nil {
+			return
+		}
+
+		for _, sibling := range n.Parent.Children {
+			if sibling != n && !yield(sibling) {
+				return
+			}
+		}
+	}
+}
+
+// NodeAt returns the innermost descendant of the node whose source contains
+// the given input offset
+func (n *Node) NodeAt(offset int) (*Node, bool) {
+	for _, child := range n.Children {
+		if child.Span.Contains(offset) {
+			if inner, ok := child.NodeAt(offset); ok {
+				return inner, true
+			}
+			return child, true
+		}
+	}
+	return nil, false
+}
+
+// setStart records the source of an element's start tag
+func (n *Node) setStart(tagStart, tagEnd int) {
+	n.Span.Start = tagStart
+	n.StartTag = Span{Start: tagStart, End: tagEnd}
+	n.Content.Start = tagEnd
+}
+
+// Complete reports whether the element's end was read from the input, as an
+// end tag or a self-closing tag
+func (n *Node) Complete() bool {
+	return n.Closure == ClosedByEndTag || n.Closure == ClosedBySelfClosingTag
+}
+
+// Incomplete returns the node, if it is an incomplete element, and all
+// incomplete elements below it, in document order
+func (n *Node) Incomplete() []*Node {
+	var result []*Node
+	if n.Type == ElementNode && !n.Complete() {
+		result = append(result, n)
+	}
+
+	for node := range n.Descendants() {
+		if node.Type == ElementNode && !node.Complete() {
+			result = append(result, node)
+		}
+	}
+
+	return result
+}
+
+// closeWith records the end of an element from its EndElement event
+func (n *Node) closeWith(event *Event) {
+	n.setEnd(event.Offset, event.EndOffset)
+
+	switch {
+	case event.Recovered:
+		n.Closure = ClosedByRecovery
+	case event.Implicit:
+		n.Closure = ClosedByEOF
+	default:
+		n.Closure = ClosedByEndTag
+	}
+}
+
+// hasAncestor reports whether an element above the node, other than the
+// document root, has the given name
+func (n *Node) hasAncestor(name string) bool {
+	for ancestor := range n.Ancestors() {
+		if ancestor.Parent != nil && ancestor.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setEnd records the source of an element's end tag. An element without an
+// end tag gets an empty end tag span where its content stops.
+func (n *Node) setEnd(tagStart, tagEnd int) {
+	n.Content.End = tagStart
+	n.EndTag = Span{Start: tagStart, End: tagEnd}
+	n.Span.End = tagEnd
+}
+
 // Document represents an XML document
 type Document struct {
-	Root *Node
+	Root        *Node
+	Diagnostics []Diagnostic // Problems in the input that parsing recovered from
 }
 
 // Parse parses an XML string and returns a Document
-func Parse(xml string) (*Document, error) {
+func Parse(xml string, opts ...Option) (*Document, error) {
 	parser := &parser{
 		input: []byte(xml),
 		pos:   0,
 		line:  1,
 		col:   1,
+		eof:   true,
+		opts:  newOptions(opts),
 	}
 
 	doc := &Document{
@@ -77,13 +253,41 @@ func Parse(xml string) (*Document, error) {
 		},
 	}
 
-	if err := parser.parse(doc.Root); err != nil {
+	err := parser.parse(doc.Root)
+	if err == nil && parser.opts.strict && parser.roots == 0 {
+		parser.diagnose(MissingRoot, "document has no root element")
+	}
+	if strictErr := parser.strictErr(); strictErr != nil {
+		err = strictErr
+	}
+
+	doc.Diagnostics = parser.diagnostics
+	if err != nil {
 		return doc, err // Return partial document with error
 	}
 
 	return doc, nil
 }
 
+// Incomplete returns the elements of the document that were not closed by an
+// end tag or a self-closing tag, in document order
+func (d *Document) Incomplete() []*Node {
+	var result []*Node
+	for node := range d.Root.Descendants() {
+		if node.Type == ElementNode && !node.Complete() {
+			result = append(result, node)
+		}
+	}
+
+	return result
+}
+
+// NodeAt returns the innermost node whose source contains the given input
+// offset
+func (d *Document) NodeAt(offset int) (*Node, bool) {
+	return d.Root.NodeAt(offset)
+}
+
 // parser represents the parsing state
 type parser struct {
 	input    []byte
@@ -91,171 +295,297 @@ type parser struct {
 	line     int
 	col      int
 	lastChar byte
+	base     int  // Input offset of input[0]
+	eof      bool // No more input will follow the current input
+	opts     options
+	run      strings.Builder // Text delivered in deltas since the last tag
+	runStart Event           // Position of the first delta of the run
+
+	diagnostics []Diagnostic // Problems recovered from so far
+	dropped     int          // Number of problems beyond the diagnostic limit
+	roots       int          // Number of elements started at the top level
+	raw         string       // Name of the raw text element being read by a Stream, if any
+	scan        scan         // Progress through a token that ran into the end of the input
+	steps       int          // Number of characters advanced over, to check that parsing is linear
+}
+
+// scan is the progress of a scanner through a token that was cut off by the
+// end of the input. A Stream reads the token again once more input arrives,
+// and the scanner resumes where it stopped instead of starting over.
+type scan struct {
+	key         string       // Scanner that made the progress, such as "text" or "-->"
+	from        int          // Input offset the scanner started at
+	to          int          // Input offset the scanner stopped at
+	line        int          // Line at to
+	col         int          // Column at to
+	lastChar    byte         // Character before to
+	diagnostics []Diagnostic // Problems the scanner recorded between from and to
+	count       int          // Number of those problems, including ones beyond the limit
+}
+
+// root counts an element started at the top level. In strict mode only one
+// is allowed.
+func (p *parser) root(offset, line, col int) {
+	if p.opts.strict && p.roots > 0 {
+		p.diagnoseAt(ContentOutsideRoot, offset, line, col, "element after the root element")
+	}
+
+	p.roots++
+}
+
+// topLevelText checks text outside of any element. In strict mode only
+// whitespace is allowed there.
+func (p *parser) topLevelText(text string, offset, line, col int) {
+	if p.opts.strict && strings.TrimSpace(text) != "" {
+		p.diagnoseAt(ContentOutsideRoot, offset, line, col, "text outside the root element")
+	}
 }
 
 // parse parses XML content and adds nodes to the given parent
-func (p *parser) parse(parent *Node) error {
+func (p *parser) parse(parent *Node) (err error) {
+	// Unless its end tag is found, the parent ends where parsing stops
+	closed := false
+	defer func() {
+		if !closed {
+			parent.setEnd(p.pos, p.pos)
+
+			// An element cut off by the end of the input inside a token
+			// is still truncated rather than recovered
+			var perr *ParseError
+			parent.Closure = ClosedByEOF
+			if err != nil && !(errors.As(err, &perr) && perr.Kind == UnexpectedEOF) {
+				parent.Closure = ClosedByRecovery
+			}
+
+			// The document root has no end tag, and in strict mode the error
+			// that stopped parsing is reported instead
+			if parent.Parent != nil && (err == nil || !p.opts.strict) {
+				p.diagnose(UnclosedElement, "element '%s' is not closed", parent.Name)
+			}
+		}
+	}()
+
 	for p.pos < len(p.input) {
+		if err := p.strictErr(); err != nil {
+			return err
+		}
+
+		start, line, col := p.pos, p.line, p.col
+
 		// Check for tag start
-		if p.pos < len(p.input) && p.input[p.pos] == '<' {
+		if markup, _ := p.markupAt(p.pos); markup {
 			p.advance() // Skip '<'
 
 			// Check what kind of tag we have
-			if p.pos < len(p.input) {
-				switch p.input[p.pos] {
-				case '/': // Closing tag
-					p.advance() // Skip '/'
-					name, err := p.readName()
-					if err != nil {
-						return err
-					}
-
-					// Skip to end of tag
-					for p.pos < len(p.input) && p.input[p.pos] != '>' {
-						p.advance()
-					}
+			switch p.input[p.pos] {
+			case '/': // Closing tag
+				p.advance() // Skip '/'
+				name, err := p.readName()
+				if err != nil {
+					return err
+				}
 
-					if p.pos < len(p.input) {
-						p.advance() // Skip '>'
-					}
+				p.skipEndTag()
+				if p.pos < len(p.input) {
+					p.advance() // Skip '>'
+				}
 
-					// Check if this closes our current node
-					if parent.Name == name {
-						return nil // Successfully closed this node
-					}
+				// Check if this closes our current node
+				if parent.Parent != nil && parent.Name == name {
+					parent.setEnd(start, p.pos)
+					parent.Closure = ClosedByEndTag
+					closed = true
+					return nil // Successfully closed this node
+				}
 
-					// Otherwise, just ignore the closing tag (flexible parsing)
+				// An end tag of an enclosing element closes this one, to be
+				// read again by the enclosing element
+				if !p.opts.strict && p.opts.endTagRecovery == CloseToMatchingElement && parent.hasAncestor(name) {
+					p.diagnoseAt(UnclosedElement, start, line, col, "element '%s' is closed by end tag '%s'", parent.Name, name)
+					parent.setEnd(start, start)
+					parent.Closure = ClosedByRecovery
+					closed = true
 
-				case '!': // Comment or DOCTYPE
-					p.advance() // Skip '!'
+					p.pos, p.line, p.col = start, line, col
+					return nil
+				}
 
-					if p.pos+1 < len(p.input) && p.input[p.pos] == '-' && p.input[p.pos+1] == '-' {
-						// Comment
-						p.advance() // Skip first '-'
-						p.advance() // Skip second '-'
+				// Otherwise, just ignore the closing tag (flexible parsing)
+				if parent.Parent == nil {
+					p.diagnoseAt(StrayEndTag, start, line, col, "end tag '%s' has no open element", name)
+				} else {
+					p.diagnoseAt(StrayEndTag, start, line, col, "end tag '%s' does not match the open element '%s'", name, parent.Name)
+				}
 
-						comment, err := p.readUntil("-->")
-						if err != nil {
-							return err
-						}
+				if !p.opts.strict && p.opts.endTagRecovery == EndTagAsText {
+					parent.Children = append(parent.Children, &Node{
+						Type:   TextNode,
+						Value:  string(p.input[start:p.pos]),
+						Parent: parent,
+						Span:   Span{Start: start, End: p.pos},
+					})
+				}
 
-						commentNode := &Node{
-							Type:   CommentNode,
-							Value:  comment,
-							Parent: parent,
-						}
+			case '!': // Comment or DOCTYPE
+				p.advance() // Skip '!'
 
-						parent.Children = append(parent.Children, commentNode)
-					} else {
-						// DOCTYPE or other declaration - treat as text for flexibility
-						text := "<!" + p.readUntilChar('>')
-						if p.pos < len(p.input) {
-							text += string(p.input[p.pos])
-							p.advance() // Skip '>'
-						}
+				if p.pos+1 < len(p.input) && p.input[p.pos] == '-' && p.input[p.pos+1] == '-' {
+					// Comment
+					p.advance() // Skip first '-'
+					p.advance() // Skip second '-'
 
-						textNode := &Node{
-							Type:   TextNode,
-							Value:  text,
-							Parent: parent,
+					// Like a Stream, keep a comment that runs into the end of
+					// the input
+					comment, err := p.readUntil("-->")
+					if err != nil {
+						p.diagnoseAt(UnterminatedComment, start, line, col, "comment is not terminated")
+						if p.opts.strict {
+							return err
 						}
-
-						parent.Children = append(parent.Children, textNode)
 					}
 
-				case '?': // Processing instruction
-					p.advance() // Skip '?'
-
-					target, err := p.readName()
-					if err != nil {
-						return err
+					commentNode := &Node{
+						Type:   CommentNode,
+						Value:  comment,
+						Parent: parent,
+						Span:   Span{Start: start, End: p.pos},
 					}
 
-					// Read PI data
-					data, err := p.readUntil("?>")
-					if err != nil {
-						return err
+					parent.Children = append(parent.Children, commentNode)
+				} else {
+					// DOCTYPE or other declaration - treat as text for flexibility
+					text := "<!" + p.readUntilChar('>')
+					if p.pos < len(p.input) {
+						text += string(p.input[p.pos])
+						p.advance() // Skip '>'
 					}
 
-					piNode := &Node{
-						Type:   ProcessingInstructionNode,
-						Name:   target,
-						Value:  strings.TrimSpace(data),
+					textNode := &Node{
+						Type:   TextNode,
+						Value:  text,
 						Parent: parent,
+						Span:   Span{Start: start, End: p.pos},
 					}
 
-					parent.Children = append(parent.Children, piNode)
+					parent.Children = append(parent.Children, textNode)
+				}
+
+			case '?': // Processing instruction
+				p.advance() // Skip '?'
 
-				default: // Opening tag
-					name, err := p.readName()
-					if err != nil {
+				target, err := p.readName()
+				if err != nil {
+					return err
+				}
+
+				// Read PI data
+				data, err := p.readUntil("?>")
+				if err != nil {
+					p.diagnoseAt(UnterminatedProcessingInstruction, start, line, col, "processing instruction is not terminated")
+					if p.opts.strict {
 						return err
 					}
+				}
 
-					node := &Node{
-						Type:     ElementNode,
-						Name:     name,
-						Children: []*Node{},
-						Attrs:    map[string]string{},
-						Parent:   parent,
-					}
+				piNode := &Node{
+					Type:   ProcessingInstructionNode,
+					Name:   target,
+					Value:  strings.TrimSpace(data),
+					Parent: parent,
+					Span:   Span{Start: start, End: p.pos},
+				}
 
-					// Parse attributes
-					for p.pos < len(p.input) && p.input[p.pos] != '>' && p.input[p.pos] != '/' {
-						p.skipWhitespace()
+				parent.Children = append(parent.Children, piNode)
 
-						if p.pos < len(p.input) && p.input[p.pos] != '>' && p.input[p.pos] != '/' {
-							attrName, attrValue, err := p.readAttribute()
-							if err != nil {
-								// Treat malformed attribute as end of attributes
-								break
-							}
+			default: // Opening tag
+				name, err := p.readName()
+				if err != nil {
+					return err
+				}
 
-							node.Attrs[attrName] = attrValue
-						}
-					}
+				// A start tag that implicitly closes this element is read
+				// again by the enclosing element
+				if p.closedByStartTag(parent, name) {
+					p.diagnoseAt(UnclosedElement, start, line, col, "element '%s' is closed by start tag '%s'", parent.Name, name)
+					parent.setEnd(start, start)
+					parent.Closure = ClosedByRecovery
+					closed = true
 
-					// Check for self-closing tag
-					selfClosing := false
-					if p.pos < len(p.input) && p.input[p.pos] == '/' {
-						selfClosing = true
-						p.advance() // Skip '/'
-					}
+					p.pos, p.line, p.col = start, line, col
+					return nil
+				}
 
-					// Skip to end of tag
-					if p.pos < len(p.input) && p.input[p.pos] == '>' {
-						p.advance() // Skip '>'
-					}
+				node := &Node{
+					Type:     ElementNode,
+					Name:     name,
+					Children: []*Node{},
+					Attrs:    map[string]string{},
+					Parent:   parent,
+				}
 
-					// Add node to parent
-					parent.Children = append(parent.Children, node)
+				if parent.Parent == nil {
+					p.root(start, line, col)
+				}
 
-					// Parse children if not self-closing
-					if !selfClosing {
-						if err := p.parse(node); err != nil {
-							// Just ignore errors when parsing children for flexibility
-						}
-					}
+				node.Attrs = p.readAttributes()
+
+				// Check for self-closing tag
+				selfClosing := false
+				if p.pos < len(p.input) && p.input[p.pos] == '/' {
+					selfClosing = true
+					p.advance() // Skip '/'
 				}
-			} else {
-				// End of input after '<', treat as text
-				textNode := &Node{
-					Type:   TextNode,
-					Value:  "<",
-					Parent: parent,
+
+				// Skip to end of tag
+				if p.pos < len(p.input) && p.input[p.pos] == '>' {
+					p.advance() // Skip '>'
 				}
 
-				parent.Children = append(parent.Children, textNode)
+				node.setStart(start, p.pos)
+
+				// Add node to parent
+				parent.Children = append(parent.Children, node)
+
+				// Parse children if not self-closing
+				if selfClosing {
+					node.setEnd(p.pos, p.pos)
+					node.Closure = ClosedBySelfClosingTag
+				} else {
+					// The content of a raw text element is one text node,
+					// followed by the end tag read as usual
+					if p.opts.isRawText(name) {
+						textStart := p.pos
+						if text, _ := p.readRawText(name); text != "" {
+							node.Children = append(node.Children, &Node{
+								Type:   TextNode,
+								Value:  text,
+								Parent: node,
+								Span:   Span{Start: textStart, End: p.pos},
+							})
+						}
+					}
+
+					// Only strict mode stops at a problem, which has been
+					// recorded already
+					if err := p.parse(node); err != nil && p.opts.strict {
+						return err
+					}
+				}
 			}
 		} else {
 			// Text content
-			text := p.readUntilChar('<')
+			text, _ := p.readText()
+			p.checkText(text, start, line, col)
+			if parent.Parent == nil {
+				p.topLevelText(text, start, line, col)
+			}
 
 			if text != "" {
 				textNode := &Node{
 					Type:   TextNode,
 					Value:  text,
 					Parent: parent,
+					Span:   Span{Start: start, End: p.pos},
 				}
 
 				parent.Children = append(parent.Children, textNode)
@@ -266,6 +596,79 @@ func (p *parser) parse(parent *Node) error {
 	return nil // Reached end of input
 }
 
+// closedByStartTag reports whether the start tag of an element named name
+// closes parent or an element enclosing it, see WithImplicitClose
+func (p *parser) closedByStartTag(parent *Node, name string) bool {
+	for node := parent; node.Parent != nil; node = node.Parent {
+		if p.opts.closesOnOpen(name, node.Name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resume moves the position to where the scanner with the given key stopped
+// the last time it started at the current position. It reports whether it
+// did, see finish.
+func (p *parser) resume(key string) bool {
+	if p.scan.key != key || p.scan.from != p.base+p.pos {
+		return false
+	}
+
+	p.pos, p.line, p.col, p.lastChar = p.scan.to-p.base, p.scan.line, p.scan.col, p.scan.lastChar
+	return true
+}
+
+// suspend records the progress of the scanner with the given key, which
+// started at from and stopped at the current position, together with the
+// problems it recorded since the diagnostics mark, see recorded. Once no
+// more input follows, there is nothing to resume.
+func (p *parser) suspend(key string, from, mark int, resumed bool) {
+	if p.eof {
+		return
+	}
+
+	var kept []Diagnostic
+	count := p.recorded() - mark
+	if resumed {
+		kept, count = p.scan.diagnostics, count+p.scan.count
+	}
+
+	diagnostics := append(kept, p.diagnostics[min(mark, len(p.diagnostics)):]...)
+	if limit := p.opts.diagnosticLimit; limit > 0 && len(diagnostics) > limit {
+		diagnostics = diagnostics[:limit]
+	}
+
+	p.scan = scan{
+		key:         key,
+		from:        p.base + from,
+		to:          p.base + p.pos,
+		line:        p.line,
+		col:         p.col,
+		lastChar:    p.lastChar,
+		diagnostics: diagnostics,
+		count:       count,
+	}
+}
+
+// finish completes a resumed scan by restoring the problems recorded before
+// it was suspended at the diagnostics mark
+func (p *parser) finish(mark int, resumed bool) {
+	if !resumed {
+		return
+	}
+
+	total := p.recorded() + p.scan.count
+	p.diagnostics = slices.Insert(p.diagnostics, min(mark, len(p.diagnostics)), p.scan.diagnostics...)
+	if limit := p.opts.diagnosticLimit; limit > 0 && len(p.diagnostics) > limit {
+		p.diagnostics = p.diagnostics[:limit]
+	}
+
+	p.dropped = total - len(p.diagnostics)
+	p.scan = scan{}
+}
+
 // advance moves the parser position forward by one character
 func (p *parser) advance() {
 	if p.pos < len(p.input) {
@@ -278,48 +681,105 @@ func (p *parser) advance() {
 
 		p.lastChar = p.input[p.pos]
 		p.pos++
+		p.steps++
 	}
 }
 
+// needMore reports whether the parser has run out of input that is not yet
+// known to be complete
+func (p *parser) needMore() bool {
+	return p.pos >= len(p.input) && !p.eof
+}
+
 // readName reads an XML name
 func (p *parser) readName() (string, error) {
-	p.skipWhitespace()
-
 	nameStart := p.pos
 
 	// First character must be a letter, underscore or colon
 	if p.pos < len(p.input) {
-		ch := p.input[p.pos]
-		if !((ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch == '_' || ch == ':') {
-			return "", fmt.Errorf("invalid name start character at line %d, column %d", p.line, p.col)
+		if !isNameStartChar(p.input[p.pos]) {
+			return "", p.errorf(InvalidName, "invalid name start character")
 		}
 
 		p.advance()
 	} else {
-		return "", fmt.Errorf("unexpected end of input when reading name at line %d, column %d", p.line, p.col)
+		return "", p.errorf(UnexpectedEOF, "unexpected end of input when reading name")
 	}
 
 	// Subsequent characters can include digits, hyphens, periods
-	for p.pos < len(p.input) {
-		ch := p.input[p.pos]
-
-		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') ||
-			ch == '_' || ch == ':' || ch == '-' || ch == '.' {
-			p.advance()
-		} else {
-			break
-		}
+	for p.pos < len(p.input) && isNameChar(p.input[p.pos]) {
+		p.advance()
 	}
 
 	if p.pos > nameStart {
 		return string(p.input[nameStart:p.pos]), nil
 	}
 
-	return "", fmt.Errorf("empty name at line %d, column %d", p.line, p.col)
+	return "", p.errorf(InvalidName, "empty name")
+}
+
+// isNameStartChar reports whether ch can start a name. Every byte of a
+// non-ASCII character counts as a name character, so names such as <名前>
+// or <é> are read whole.
+func isNameStartChar(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch == '_' || ch == ':' || ch >= 0x80
+}
+
+// isNameChar reports whether ch can appear in a name
+func isNameChar(ch byte) bool {
+	return isNameStartChar(ch) || (ch >= '0' && ch <= '9') || ch == '-' || ch == '.'
+}
+
+// skipEndTag skips the rest of an end tag after its name, up to and
+// including the '>'
+func (p *parser) skipEndTag() {
+	p.skipWhitespace()
+
+	if p.opts.strict && p.pos < len(p.input) && p.input[p.pos] != '>' {
+		p.diagnose(InvalidMarkup, "unexpected character in end tag")
+	}
+
+	for p.pos < len(p.input) && p.input[p.pos] != '>' {
+		p.advance()
+	}
+}
+
+// readAttributes reads the attributes of a start tag
+func (p *parser) readAttributes() map[string]string {
+	attrs := make(map[string]string)
+
+	for p.pos < len(p.input) && p.input[p.pos] != '>' && p.input[p.pos] != '/' {
+		p.skipWhitespace()
+
+		if p.pos < len(p.input) && p.input[p.pos] != '>' && p.input[p.pos] != '/' {
+			start, line, col := p.base+p.pos, p.line, p.col
+
+			if p.opts.strict && len(attrs) > 0 && !isWhitespace(p.lastChar) {
+				p.diagnose(BadAttribute, "attributes must be separated by whitespace")
+			}
+
+			attrName, attrValue, err := p.readAttribute()
+			if err != nil {
+				// Treat malformed attribute as end of attributes
+				p.diagnoseAt(BadAttribute, start, line, col, "malformed attribute: %v", err)
+				break
+			}
+
+			if _, ok := attrs[attrName]; ok {
+				p.diagnoseAt(BadAttribute, start, line, col, "duplicate attribute '%s'", attrName)
+			}
+
+			attrs[attrName] = attrValue
+		}
+	}
+
+	return attrs
 }
 
 // readAttribute reads an attribute name and value
 func (p *parser) readAttribute() (string, string, error) {
+	start, line, col := p.base+p.pos, p.line, p.col
+
 	name, err := p.readName()
 	if err != nil {
 		return "", "", err
@@ -330,6 +790,7 @@ func (p *parser) readAttribute() (string, string, error) {
 	// Check for equals sign
 	if p.pos >= len(p.input) || p.input[p.pos] != '=' {
 		// For flexibility, allow attributes without values
+		p.diagnoseAt(BadAttribute, start, line, col, "attribute '%s' has no value", name)
 		return name, "", nil
 	}
 
@@ -338,6 +799,7 @@ func (p *parser) readAttribute() (string, string, error) {
 
 	// Read value
 	if p.pos >= len(p.input) {
+		p.diagnoseAt(BadAttribute, start, line, col, "attribute '%s' has no value", name)
 		return name, "", nil // Empty value for flexibility
 	}
 
@@ -345,21 +807,34 @@ func (p *parser) readAttribute() (string, string, error) {
 		quote := p.input[p.pos]
 		p.advance() // Skip quote
 
-		valueStart := p.pos
+		valueStart, valueLine, valueCol := p.pos, p.line, p.col
+		p.resume(string(quote))
 
 		for p.pos < len(p.input) && p.input[p.pos] != quote {
 			p.advance()
 		}
 
+		// The tag is read again once more input arrives
+		if p.needMore() {
+			p.suspend(string(quote), valueStart, p.recorded(), false)
+			return name, "", nil
+		}
+
 		value := string(p.input[valueStart:p.pos])
 
+		// A value that is not terminated runs into whatever follows, so
+		// only a terminated value is checked
 		if p.pos < len(p.input) {
+			p.checkAttributeValue(value, p.base+valueStart, valueLine, valueCol)
 			p.advance() // Skip closing quote
+		} else {
+			p.diagnoseAt(BadAttribute, start, line, col, "value of attribute '%s' is not terminated", name)
 		}
 
 		return name, value, nil
 	} else {
 		// Unquoted value (non-standard but flexible)
+		p.diagnoseAt(BadAttribute, start, line, col, "attribute '%s' has an unquoted value", name)
 		valueStart := p.pos
 
 		for p.pos < len(p.input) && !isWhitespace(p.input[p.pos]) && p.input[p.pos] != '>' && p.input[p.pos] != '/' {
@@ -374,6 +849,7 @@ func (p *parser) readAttribute() (string, string, error) {
 // readUntil reads until the given delimiter is found
 func (p *parser) readUntil(delimiter string) (string, error) {
 	start := p.pos
+	p.resume(delimiter)
 
 	for p.pos <= len(p.input)-len(delimiter) {
 		if string(p.input[p.pos:p.pos+len(delimiter)]) == delimiter {
@@ -390,19 +866,181 @@ func (p *parser) readUntil(delimiter string) (string, error) {
 		p.advance()
 	}
 
-	// Reached end of input without finding delimiter
-	result := string(p.input[start:p.pos])
-	return result, fmt.Errorf("unexpected end of input while looking for %q", delimiter)
+	// Reached end of input without finding delimiter. The bytes that may
+	// start the delimiter are checked again once more input arrives.
+	p.suspend(delimiter, start, p.recorded(), false)
+	for p.pos < len(p.input) {
+		p.advance()
+	}
+
+	// The text read so far is only used once no more input follows
+	result := ""
+	if p.eof {
+		result = string(p.input[start:p.pos])
+	}
+
+	return result, p.errorf(UnexpectedEOF, "unexpected end of input while looking for %q", delimiter)
+}
+
+// markupAt reports whether the '<' at pos starts markup that is parsed, see
+// markupSyntaxAt and WithKnownTags. If the input ends before this can be
+// decided and more input may follow, incomplete is true.
+func (p *parser) markupAt(pos int) (markup, incomplete bool) {
+	markup, incomplete = p.markupSyntaxAt(pos)
+	if !markup || p.opts.knownTags == nil {
+		return markup, incomplete
+	}
+
+	// Only tags with a known name are markup
+	start := pos + 1
+	if p.input[start] == '/' {
+		start++
+	}
+
+	end := start
+	for end < len(p.input) && isNameChar(p.input[end]) {
+		end++
+	}
+
+	if end >= len(p.input) && !p.eof {
+		return false, true
+	}
+
+	return slices.Contains(p.opts.knownTags, string(p.input[start:end])), false
+}
+
+// markupSyntaxAt reports whether the '<' at pos starts a tag, comment,
+// declaration or processing instruction. If the input ends before this can
+// be decided and more input may follow, incomplete is true.
+func (p *parser) markupSyntaxAt(pos int) (markup, incomplete bool) {
+	if pos >= len(p.input) || p.input[pos] != '<' {
+		return false, false
+	}
+
+	// Look at up to two characters after the '<'
+	for i := pos + 1; i <= pos+2; i++ {
+		if i >= len(p.input) {
+			return false, !p.eof
+		}
+
+		ch := p.input[i]
+		switch {
+		case isNameStartChar(ch):
+			return true, false
+		case ch == '!' && i == pos+1:
+			return true, false
+		case (ch == '/' || ch == '?') && i == pos+1:
+			continue
+		default:
+			return false, false
+		}
+	}
+
+	return false, false
+}
+
+// readText reads text up to the next '<' that starts markup. Any other '<'
+// is kept as text. It reports whether it stopped at a '<' that may or may
+// not start markup once more input arrives.
+func (p *parser) readText() (string, bool) {
+	start := p.pos
+	undecided := p.scanText()
+
+	return string(p.input[start:p.pos]), undecided
+}
+
+// scanText moves past text like readText, without copying it
+func (p *parser) scanText() bool {
+	start := p.pos
+	diagnostics := p.recorded()
+	resumed := p.resume("text")
+
+	for p.pos < len(p.input) {
+		if p.input[p.pos] == '<' {
+			markup, incomplete := p.markupAt(p.pos)
+			if incomplete {
+				p.suspend("text", start, diagnostics, resumed)
+				return true
+			}
+			if markup {
+				break
+			}
+
+			// Tags with unknown names are text on purpose
+			if syntax, _ := p.markupSyntaxAt(p.pos); !syntax {
+				p.diagnose(StrayLessThan, "'<' does not start markup")
+			}
+		}
+
+		p.advance()
+	}
+
+	if p.needMore() {
+		p.suspend("text", start, diagnostics, resumed)
+	} else {
+		p.finish(diagnostics, resumed)
+	}
+
+	return false
+}
+
+// readRawText reads the content of the raw text element name verbatim, up
+// to its end tag. It reports whether it stopped at a '<' that may or may not
+// start the end tag once more input arrives.
+func (p *parser) readRawText(name string) (string, bool) {
+	start := p.pos
+	undecided := p.scanRawText(name)
+
+	return string(p.input[start:p.pos]), undecided
+}
+
+// scanRawText moves past raw text like readRawText, without copying it
+func (p *parser) scanRawText(name string) bool {
+	start := p.pos
+	end := "</" + name
+	p.resume(end)
+
+	for p.pos < len(p.input) {
+		if p.input[p.pos] == '<' {
+			rest := p.input[p.pos:]
+
+			switch {
+			case len(rest) > len(end):
+				if string(rest[:len(end)]) == end && !isNameChar(rest[len(end)]) {
+					return false
+				}
+			case !strings.HasPrefix(end, string(rest)):
+			case !p.eof:
+				p.suspend(end, start, p.recorded(), false)
+				return true
+			case len(rest) == len(end):
+				// End tag cut off by the end of the input
+				return false
+			}
+		}
+
+		p.advance()
+	}
+
+	p.suspend(end, start, p.recorded(), false)
+	return false
 }
 
 // readUntilChar reads until the given character is found
 func (p *parser) readUntilChar(ch byte) string {
 	start := p.pos
+	p.resume(string(ch))
 
 	for p.pos < len(p.input) && p.input[p.pos] != ch {
 		p.advance()
 	}
 
+	// The text read so far is only used once no more input follows
+	if p.needMore() {
+		p.suspend(string(ch), start, p.recorded(), false)
+		return ""
+	}
+
 	return string(p.input[start:p.pos])
 }
 
@@ -1,6 +1,7 @@
 package flexml
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -523,3 +524,502 @@ func TestStringMethod(t *testing.T) {
 		t.Fatalf("Expected text 'Content', got '%s'", child[0].GetText())
 	}
 }
+
+func TestSourceSpans(t *testing.T) {
+	xml := `<response><answer id="1">The answer</answer><!-- note --><partial>cut`
+
+	doc, err := Parse(xml)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	answer, ok := doc.FindOne("answer")
+	if !ok {
+		t.Fatal("Failed to find answer element")
+	}
+
+	if got := xml[answer.StartTag.Start:answer.StartTag.End]; got != `<answer id="1">` {
+		t.Errorf("Expected start tag '<answer id=\"1\">', got %q", got)
+	}
+
+	if got := xml[answer.Content.Start:answer.Content.End]; got != "The answer" {
+		t.Errorf("Expected content 'The answer', got %q", got)
+	}
+
+	if got := xml[answer.EndTag.Start:answer.EndTag.End]; got != "</answer>" {
+		t.Errorf("Expected end tag '</answer>', got %q", got)
+	}
+
+	// An element cut off by the end of the input has no end tag
+	partial, ok := doc.FindOne("partial")
+	if !ok {
+		t.Fatal("Failed to find partial element")
+	}
+
+	if partial.EndTag.Start != len(xml) || partial.EndTag.End != len(xml) {
+		t.Errorf("Expected empty end tag at end of input, got %+v", partial.EndTag)
+	}
+
+	node, ok := doc.NodeAt(strings.Index(xml, "answer</"))
+	if !ok || node.Type != TextNode || node.Parent != answer {
+		t.Errorf("Expected text of answer at offset, got %v", node)
+	}
+
+	node, ok = doc.NodeAt(strings.Index(xml, "note"))
+	if !ok || node.Type != CommentNode {
+		t.Errorf("Expected comment at offset, got %v", node)
+	}
+}
+
+func TestNodeIterators(t *testing.T) {
+	xml := `<doc><a>one<b/>two</a><c><d>deep</d></c><!-- note --><e/></doc>`
+
+	doc, err := Parse(xml)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	root, _ := doc.FindOne("doc")
+
+	var names []string
+	for node := range root.Descendants() {
+		if node.Type == ElementNode {
+			names = append(names, node.Name)
+		}
+	}
+
+	if strings.Join(names, ",") != "a,b,c,d,e" {
+		t.Errorf("Expected descendants a,b,c,d,e, got %s", strings.Join(names, ","))
+	}
+
+	names = nil
+	for node := range root.ChildElements() {
+		names = append(names, node.Name)
+	}
+
+	if strings.Join(names, ",") != "a,c,e" {
+		t.Errorf("Expected child elements a,c,e, got %s", strings.Join(names, ","))
+	}
+
+	d, _ := doc.FindOne("d")
+
+	names = nil
+	for node := range d.Ancestors() {
+		names = append(names, node.Name)
+	}
+
+	if strings.Join(names, ",") != "c,doc,root" {
+		t.Errorf("Expected ancestors c,doc,root, got %s", strings.Join(names, ","))
+	}
+
+	c, _ := doc.FindOne("c")
+
+	siblings := 0
+	for node := range c.Siblings() {
+		if node == c {
+			t.Error("Siblings should not include the node itself")
+		}
+		siblings++
+	}
+
+	if siblings != 3 {
+		t.Errorf("Expected 3 siblings, got %d", siblings)
+	}
+
+	// Stopping early must be honored
+	count := 0
+	for range root.Descendants() {
+		count++
+		if count == 2 {
+			break
+		}
+	}
+
+	if count != 2 {
+		t.Errorf("Expected iteration to stop after 2 nodes, got %d", count)
+	}
+}
+
+func TestNodeClosure(t *testing.T) {
+	input := `<doc><a>x</a><b/><c>y</c><e>unfinished<d>x <!-- open`
+	doc, _ := Parse(input)
+
+	expected := map[string]Closure{
+		"doc": ClosedByEOF,
+		"a":   ClosedByEndTag,
+		"b":   ClosedBySelfClosingTag,
+		"c":   ClosedByEndTag,
+		"d":   ClosedByEOF,
+		"e":   ClosedByEOF,
+	}
+
+	for name, closure := range expected {
+		node, found := doc.FindOne(name)
+		if !found {
+			t.Fatalf("Expected to find %s", name)
+		}
+
+		if node.Closure != closure {
+			t.Errorf("Expected %s to have closure %d, got %d", name, closure, node.Closure)
+		}
+	}
+
+	var names []string
+	for _, node := range doc.Incomplete() {
+		names = append(names, node.Name)
+	}
+
+	if strings.Join(names, ",") != "doc,e,d" {
+		t.Errorf("Expected incomplete elements doc,e,d, got %s", strings.Join(names, ","))
+	}
+
+	e, _ := doc.FindOne("e")
+	if e.Complete() || len(e.Incomplete()) != 2 {
+		t.Errorf("Expected e and d to be incomplete, got %v", e.Incomplete())
+	}
+
+	c, _ := doc.FindOne("c")
+	if !c.Complete() || len(c.Incomplete()) != 0 {
+		t.Errorf("Expected c to be complete, got %v", c.Incomplete())
+	}
+
+	// An element cut off inside a comment is truncated in every parser
+	strictDoc, err := Parse(input, WithStrict())
+	if err == nil {
+		t.Fatalf("Expected strict mode to reject the unterminated comment")
+	}
+
+	if d, _ := strictDoc.FindOne("d"); d.Closure != ClosedByEOF {
+		t.Errorf("Expected d to have closure %d in strict mode, got %d", ClosedByEOF, d.Closure)
+	}
+
+	streamDoc, _ := ParseReader(strings.NewReader(input))
+	if d, _ := streamDoc.FindOne("d"); d.Closure != ClosedByEOF {
+		t.Errorf("Expected d to have closure %d in the stream, got %d", ClosedByEOF, d.Closure)
+	}
+}
+
+func TestLiteralLessThan(t *testing.T) {
+	xml := `<answer>if x < 5 and a <= b, then <3 <?! done</answer><next/>`
+
+	doc, err := Parse(xml)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	answer, _ := doc.FindOne("answer")
+	if len(answer.Children) != 1 || answer.GetText() != "if x < 5 and a <= b, then <3 <?! done" {
+		t.Errorf("Expected the prose as one text node, got %s", answer.String())
+	}
+
+	if next, found := doc.FindOne("next"); !found || next.Parent != doc.Root {
+		t.Errorf("Expected parsing to continue after the prose, got %s", doc.String())
+	}
+
+	if len(doc.Diagnostics) != 4 || doc.Diagnostics[0].Kind != StrayLessThan || doc.Diagnostics[0].Offset != 13 {
+		t.Errorf("Expected a diagnostic for each literal '<', got %v", doc.Diagnostics)
+	}
+}
+
+// compact renders the children of a node on one line, without attributes
+func compact(n *Node) string {
+	var sb strings.Builder
+	for _, child := range n.Children {
+		switch {
+		case child.Type == TextNode:
+			sb.WriteString(child.Value)
+		case child.Type != ElementNode:
+		case len(child.Children) == 0:
+			sb.WriteString("<" + child.Name + "/>")
+		default:
+			sb.WriteString("<" + child.Name + ">" + compact(child) + "</" + child.Name + ">")
+		}
+	}
+	return sb.String()
+}
+
+func TestEndTagRecovery(t *testing.T) {
+	xml := `<a><b>text</a><c/></x>`
+
+	tests := []struct {
+		name     string
+		recovery EndTagRecovery
+		expected string
+		cParent  string
+		bClosure Closure
+	}{
+		{"Close to matching element", CloseToMatchingElement, "<a><b>text</b></a><c/>", "root", ClosedByRecovery},
+		{"Ignore end tag", IgnoreEndTag, "<a><b>text<c/></b></a>", "b", ClosedByEOF},
+		{"End tag as text", EndTagAsText, "<a><b>text</a><c/></x></b></a>", "b", ClosedByEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc, err := Parse(xml, WithEndTagRecovery(test.recovery))
+			if err != nil {
+				t.Fatalf("Parse error: %v", err)
+			}
+
+			if got := compact(doc.Root); got != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, got)
+			}
+
+			c, _ := doc.FindOne("c")
+			if c.Parent.Name != test.cParent {
+				t.Errorf("Expected c inside %s, got %s", test.cParent, c.Parent.Name)
+			}
+
+			b, _ := doc.FindOne("b")
+			if b.Closure != test.bClosure {
+				t.Errorf("Expected b to have closure %d, got %d", test.bClosure, b.Closure)
+			}
+
+			// The streaming tree builder recovers the same way
+			builder := NewTreeBuilder(WithEndTagRecovery(test.recovery))
+			builder.AddData([]byte(xml))
+			builder.EOF()
+
+			if got := compact(builder.Document().Root); got != test.expected {
+				t.Errorf("Expected TreeBuilder to build %s, got %s", test.expected, got)
+			}
+
+			if !reflect.DeepEqual(builder.Document().Diagnostics, doc.Diagnostics) {
+				t.Errorf("Expected the same diagnostics:\n%v\nGot:\n%v", doc.Diagnostics, builder.Document().Diagnostics)
+			}
+		})
+	}
+}
+
+func TestImplicitClose(t *testing.T) {
+	xml := `<think>plan <b>x<answer id="1">42</answer></think><list><item>a<item>b</item></list>`
+	opts := []Option{WithImplicitClose("answer", "think"), WithImplicitClose("item", "item")}
+
+	expected := "<think>plan <b>x</b></think><answer>42</answer><list><item>a</item><item>b</item></list>"
+
+	doc, err := Parse(xml, opts...)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	if got := compact(doc.Root); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+
+	answer, _ := doc.FindOne("answer")
+	if answer.Parent != doc.Root || answer.Attrs["id"] != "1" {
+		t.Errorf("Expected answer at the top level, got it inside %s", answer.Parent.Name)
+	}
+
+	think, _ := doc.FindOne("think")
+	if think.Closure != ClosedByRecovery || think.Span.End != strings.Index(xml, "<answer") {
+		t.Errorf("Expected think to be closed by recovery before answer, got %d ending at %d", think.Closure, think.Span.End)
+	}
+
+	messages := []string{}
+	for _, d := range doc.Diagnostics {
+		messages = append(messages, d.Message)
+	}
+
+	expectedMessages := []string{
+		"element 'b' is closed by start tag 'answer'",
+		"element 'think' is closed by start tag 'answer'",
+		"end tag 'think' has no open element",
+		"element 'item' is closed by start tag 'item'",
+	}
+
+	if !reflect.DeepEqual(messages, expectedMessages) {
+		t.Errorf("Expected diagnostics:\n%q\nGot:\n%q", expectedMessages, messages)
+	}
+
+	// The streaming builders apply the same rules, however the input is split
+	builder := NewTreeBuilder(opts...)
+	for i := range len(xml) {
+		builder.AddData([]byte{xml[i]})
+	}
+	builder.EOF()
+
+	if got := compact(builder.Document().Root); got != expected {
+		t.Errorf("Expected TreeBuilder to build %s, got %s", expected, got)
+	}
+
+	if !reflect.DeepEqual(builder.Document().Diagnostics, doc.Diagnostics) {
+		t.Errorf("Expected the same diagnostics:\n%v\nGot:\n%v", doc.Diagnostics, builder.Document().Diagnostics)
+	}
+
+	streamDoc, err := ParseReader(strings.NewReader(xml), opts...)
+	if err != nil {
+		t.Fatalf("ParseReader error: %v", err)
+	}
+
+	names := []string{}
+	for _, node := range streamDoc.Nodes {
+		names = append(names, node.Name)
+	}
+
+	if !reflect.DeepEqual(names, []string{"think", "answer", "list"}) {
+		t.Errorf("Expected ParseReader to return think, answer and list, got %v", names)
+	}
+
+	if !reflect.DeepEqual(streamDoc.Diagnostics, doc.Diagnostics) {
+		t.Errorf("Expected the same diagnostics:\n%v\nGot:\n%v", doc.Diagnostics, streamDoc.Diagnostics)
+	}
+
+	// Without the rules the answer stays inside the thinking
+	doc, _ = Parse(xml)
+	if answer, _ := doc.FindOne("answer"); answer.Parent.Name != "b" {
+		t.Errorf("Expected answer inside b without rules, got %s", answer.Parent.Name)
+	}
+
+	// Strict mode does not apply the rules
+	if _, err := Parse(xml, append(opts, WithStrict())...); err == nil {
+		t.Errorf("Expected strict mode to reject the missing end tag")
+	}
+}
+
+func TestRawText(t *testing.T) {
+	code := "\n  List<String> x = a < b && c;\n  <div class=\"x\"><!-- y --></div></codes>\n"
+	xml := "<answer><code lang=\"java\">" + code + "</code ><b>done</b></answer>"
+
+	doc, err := Parse(xml, WithRawText("code"))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	node, found := doc.FindOne("code")
+	if !found {
+		t.Fatalf("Expected a code element")
+	}
+
+	if len(node.Children) != 1 || node.GetText() != code {
+		t.Errorf("Expected the exact source as text, got %d children and %q", len(node.Children), node.GetText())
+	}
+
+	if node.Closure != ClosedByEndTag || node.Attrs["lang"] != "java" {
+		t.Errorf("Expected code to be closed by its end tag, got %d", node.Closure)
+	}
+
+	if b, _ := doc.FindOne("b"); b.Parent.Name != "answer" {
+		t.Errorf("Expected b after the code, got it inside %s", b.Parent.Name)
+	}
+
+	if len(doc.Diagnostics) != 0 {
+		t.Errorf("Expected no diagnostics, got %v", doc.Diagnostics)
+	}
+
+	if _, err := Parse(xml, WithRawText("code"), WithStrict()); err != nil {
+		t.Errorf("Expected strict mode to accept raw text, got %v", err)
+	}
+
+	// The stream reads the same text, however the input is split
+	for _, deltas := range []bool{false, true} {
+		opts := []Option{WithRawText("code"), WithStrict()}
+		if deltas {
+			opts = append(opts, WithTextDeltas())
+		}
+
+		stream := NewStream(opts...)
+		text := ""
+		for i := range len(xml) {
+			stream.AddData([]byte{xml[i]})
+			for stream.Next() {
+				if event := stream.Event(); event.Type == Text && event.Parent == "code" {
+					text += event.Text
+				}
+			}
+		}
+		stream.EOF()
+		for stream.Next() {
+		}
+
+		if text != code {
+			t.Errorf("Expected the stream to read the exact source with deltas %v, got %q", deltas, text)
+		}
+
+		if stream.Err() != nil || len(stream.Diagnostics()) != 0 {
+			t.Errorf("Expected no stream errors, got %v and %v", stream.Err(), stream.Diagnostics())
+		}
+	}
+
+	reader := NewElementStreamReader(strings.NewReader(xml), WithRawText("code"))
+	answer, err := reader.ReadNode()
+	if err != nil {
+		t.Fatalf("ReadNode error: %v", err)
+	}
+
+	if node, _ := answer.FindOne("code"); node.GetText() != code {
+		t.Errorf("Expected ReadNode to keep the exact source, got %q", node.GetText())
+	}
+
+	// A raw text element that is not closed extends to the end of the input
+	unclosed := "<code>a <b> </cod"
+	doc, _ = Parse(unclosed, WithRawText("code"))
+	if node, _ := doc.FindOne("code"); node.GetText() != "a <b> </cod" || node.Closure != ClosedByEOF {
+		t.Errorf("Expected the rest of the input as text, got %q", node.GetText())
+	}
+
+	streamDoc, _ := ParseReader(strings.NewReader(unclosed), WithRawText("code"))
+	if node, _ := streamDoc.FindOne("code"); node.GetText() != "a <b> </cod" || node.Closure != ClosedByEOF {
+		t.Errorf("Expected the stream to read the rest of the input as text, got %q", node.GetText())
+	}
+}
+
+func TestKnownTags(t *testing.T) {
+	xml := "<think>Use <b>List<T></b> here<!-- x --></think ><answer>1 < 2<think/></answer><tool_call/>"
+	opts := []Option{WithKnownTags("think", "answer"), WithKnownTags("tool_call")}
+
+	expected := "<think>Use <b>List<T></b> here<!-- x --></think><answer>1 < 2<think/></answer><tool_call/>"
+
+	doc, err := Parse(xml, opts...)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	if got := compact(doc.Root); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+
+	if think, _ := doc.FindOne("think"); think.GetText() != "Use <b>List<T></b> here<!-- x -->" {
+		t.Errorf("Expected the unknown tags as text, got %q", think.GetText())
+	}
+
+	// Only the '<' that does not start a tag at all is recorded
+	if len(doc.Diagnostics) != 1 || doc.Diagnostics[0].Kind != StrayLessThan {
+		t.Errorf("Expected one stray '<', got %v", doc.Diagnostics)
+	}
+
+	// The stream builds the same tree, however the input is split
+	builder := NewTreeBuilder(opts...)
+	for i := range len(xml) {
+		builder.AddData([]byte{xml[i]})
+	}
+	builder.EOF()
+
+	if got := compact(builder.Document().Root); got != expected {
+		t.Errorf("Expected TreeBuilder to build %s, got %s", expected, got)
+	}
+
+	if !reflect.DeepEqual(builder.Document().Diagnostics, doc.Diagnostics) {
+		t.Errorf("Expected the same diagnostics:\n%v\nGot:\n%v", doc.Diagnostics, builder.Document().Diagnostics)
+	}
+
+	stream := NewStream(append(opts, WithTextDeltas())...)
+	stream.AddData([]byte(xml))
+	stream.EOF()
+
+	text := ""
+	for _, event := range collectEvents(stream) {
+		if event.Type == Text && event.Parent == "think" {
+			text += event.Text
+		}
+	}
+
+	if text != "Use <b>List<T></b> here<!-- x -->" {
+		t.Errorf("Expected the stream to keep the unknown tags as text, got %q", text)
+	}
+
+	// A name is only known once it is complete
+	doc, _ = Parse("<think><thinking>x</thinking></think>", opts...)
+	if think, _ := doc.FindOne("think"); think.GetText() != "<thinking>x</thinking>" {
+		t.Errorf("Expected thinking to be text, got %q", think.GetText())
+	}
+}